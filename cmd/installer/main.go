@@ -18,13 +18,38 @@ import (
 	"flag"
 	"github.com/golang/glog"
 	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/installer"
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
 )
 
 func main() {
 	namespace := flag.String("namespace", "kube-system", "Namespace in which all Kubernetes resources will be created.")
 	prefix := flag.String("name", "network-resources-injector", "Prefix added to the names of all created resources.")
+	certManager := flag.Bool("cert-manager", false, "Use cert-manager to issue the webhook serving certificate instead of the Kubernetes CSR API.")
+	issuerKind := flag.String("cert-manager-issuer-kind", "Issuer", "Kind of the cert-manager issuer (Issuer or ClusterIssuer) used with --cert-manager.")
+	issuerName := flag.String("cert-manager-issuer-name", "", "Name of an existing cert-manager issuer used with --cert-manager. A self-signed Issuer is created if empty.")
+	reinvocationPolicy := flag.String("reinvocation-policy", "Never", "Reinvocation policy of the mutating webhook (Never or IfNeeded). IfNeeded calls the webhook again if other mutating webhooks modify the pod.")
+	timeoutSeconds := flag.Int("timeout-seconds", types.DefaultTimeoutSeconds, "Time in seconds the API server waits for the webhook, between 1 and 30. It must match timeoutSeconds of the webhook configuration file.")
+	failurePolicy := flag.String("failure-policy", "Ignore", "Failure policy of the mutating webhook (Ignore or Fail). Fail rejects pods when the webhook can not be called or times out, use it with failurePolicy Deny of the webhook configuration file.")
 	flag.Parse()
 
+	if err := installer.SetReinvocationPolicy(*reinvocationPolicy); err != nil {
+		glog.Fatal(err)
+	}
+	if err := installer.SetTimeoutSeconds(*timeoutSeconds); err != nil {
+		glog.Fatal(err)
+	}
+	if err := installer.SetFailurePolicy(*failurePolicy); err != nil {
+		glog.Fatal(err)
+	}
+
+	if *certManager && *issuerKind != "Issuer" && *issuerKind != "ClusterIssuer" {
+		glog.Fatalf("invalid cert-manager issuer kind '%s'. Choose between Issuer and ClusterIssuer", *issuerKind)
+	}
+
 	glog.Info("starting webhook installation")
+	if *certManager {
+		installer.InstallWithCertManager(*namespace, *prefix, *issuerKind, *issuerName)
+		return
+	}
 	installer.Install(*namespace, *prefix)
 }
@@ -15,19 +15,25 @@
 package main
 
 import (
-	"crypto/tls"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	"github.com/fsnotify/fsnotify"
 	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
 	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/webhook"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
@@ -35,19 +41,40 @@ const (
 	userDefinedInjectionConfigMap = "nri-user-defined-injections"
 )
 
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
 func main() {
 	var namespace string
 	var clientCAPaths webhook.ClientCAFlags
+	var allowedClientCNs, allowedClientSANs, allowedClientOrgs webhook.StringFlags
 	/* load configuration */
 	port := flag.Int("port", 8443, "The port on which to serve.")
 	address := flag.String("bind-address", "0.0.0.0", "The IP address on which to listen for the --port port.")
 	cert := flag.String("tls-cert-file", "cert.pem", "File containing the default x509 Certificate for HTTPS.")
 	key := flag.String("tls-private-key-file", "key.pem", "File containing the default x509 private key matching --tls-cert-file.")
+	configFile := flag.String("config", "", "File containing the NRIConfiguration, e.g. a mounted ConfigMap. It is reloaded when changed and on SIGHUP.")
 	insecure := flag.Bool("insecure", false, "Disable adding client CA to server TLS endpoint --insecure")
 	injectHugepageDownApi := flag.Bool("injectHugepageDownApi", false, "Enable hugepage requests and limits into Downward API.")
 	flag.Var(&clientCAPaths, "client-ca", "File containing client CA. This flag is repeatable if more than one client CA needs to be added to server")
-	resourceNameKeys := flag.String("network-resource-name-keys", "k8s.v1.cni.cncf.io/resourceName", "comma separated resource name keys --network-resource-name-keys.")
+	flag.Var(&allowedClientCNs, "allowed-client-cn", "Common name of a client certificate allowed to call the webhook. This flag is repeatable. All verified clients are allowed if no allowed-client-* flag is given.")
+	flag.Var(&allowedClientSANs, "allowed-client-san", "Subject alternative name of a client certificate allowed to call the webhook. This flag is repeatable.")
+	flag.Var(&allowedClientOrgs, "allowed-client-org", "Organization of a client certificate allowed to call the webhook. This flag is repeatable.")
+	resourceNameKeys := flag.String("network-resource-name-keys", types.DefaultResourceNameKey, "comma separated resource name keys --network-resource-name-keys.")
 	resourcesHonorFlag := flag.Bool("honor-resources", false, "Honor the existing requested resources requests & limits --honor-resources")
+	tlsProfile := flag.String("tls-profile", webhook.TLSProfileDefault, "TLS profile of the server: Default, Old, Intermediate, Modern or FIPS.")
+	tlsMinVersion := flag.String("tls-min-version", "", "Minimum TLS version, overrides the profile: VersionTLS10, VersionTLS11, VersionTLS12 or VersionTLS13.")
+	tlsMaxVersion := flag.String("tls-max-version", "", "Maximum TLS version, overrides the profile: VersionTLS10, VersionTLS11, VersionTLS12 or VersionTLS13.")
+	tlsCipherSuites := flag.String("tls-cipher-suites", "", "Comma separated list of TLS 1.2 cipher suites, overrides the profile, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.")
+	tlsCurves := flag.String("tls-curves", "", "Comma separated list of elliptic curves, overrides the profile: X25519, P-256, P-384 or P-521.")
+	filePollInterval := flag.Duration("file-poll-interval", time.Minute, "Interval at which certificate and configuration files are checked for changes in addition to file system events.")
+	metricsAddress := flag.String("metrics-address", "", "The address on which to expose Prometheus metrics and the /healthz and /readyz probes over HTTP, e.g. ':9090'. Disabled if empty.")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "Time between reporting not ready and closing the listener on SIGTERM, to let the API server stop sending requests.")
+	shutdownGracePeriod := flag.Duration("shutdown-grace-period", 20*time.Second, "Maximum time to wait for in-flight requests to complete on SIGTERM.")
 	flag.Parse()
 
 	if *port < 1024 || *port > 65535 {
@@ -58,6 +85,12 @@ func main() {
 		glog.Fatalf("input argument(s) not defined correctly")
 	}
 
+	tlsPolicy, err := webhook.NewTLSPolicy(*tlsProfile, *tlsMinVersion, *tlsMaxVersion,
+		splitList(*tlsCipherSuites), splitList(*tlsCurves))
+	if err != nil {
+		glog.Fatalf("invalid TLS configuration: %s", err.Error())
+	}
+
 	if len(clientCAPaths) == 0 {
 		clientCAPaths = append(clientCAPaths, defaultClientCa)
 	}
@@ -78,119 +111,184 @@ func main() {
 		glog.Fatalf("error loading client CA pool: '%s'", err.Error())
 	}
 
+	clientAuthorizer := webhook.NewClientAuthorizer(allowedClientCNs, allowedClientSANs, allowedClientOrgs)
+
 	/* init API client */
 	clientset := webhook.SetupInClusterClient()
+	wh, err := webhook.NewWebhook(webhook.Options{Clientset: clientset})
+	if err != nil {
+		glog.Fatalf("error creating webhook: %s", err.Error())
+	}
 
-	webhook.SetInjectHugepageDownApi(*injectHugepageDownApi)
+	/* flags given on the command line take precedence over the configuration file */
+	flagOverrides := func(config *types.NRIConfiguration) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "injectHugepageDownApi":
+				config.InjectHugepageDownAPI = *injectHugepageDownApi
+			case "honor-resources":
+				config.HonorExistingResources = *resourcesHonorFlag
+			case "network-resource-name-keys":
+				config.ResourceNameKeys, _ = webhook.ParseResourceNameKeys(*resourceNameKeys)
+			}
+		})
+	}
+	if err := wh.ReloadConfiguration(*configFile, flagOverrides); err != nil {
+		glog.Fatalf("error loading configuration: %s", err.Error())
+	}
+	reloadConfiguration := func() error {
+		return wh.ReloadConfiguration(*configFile, flagOverrides)
+	}
 
-	webhook.SetHonorExistingResources(*resourcesHonorFlag)
+	/* readiness is reported once the server listens and withdrawn on shutdown */
+	var ready int32
 
-	err = webhook.SetResourceNameKeys(*resourceNameKeys)
-	if err != nil {
-		glog.Fatalf("error in setting resource name keys: %s", err.Error())
+	if *metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", webhook.MetricsHandler())
+			mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			})
+			mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&ready) == 0 {
+					http.Error(w, "not ready", http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("ok"))
+			})
+			glog.Infof("exposing metrics and health probes on %s", *metricsAddress)
+			if err := http.ListenAndServe(*metricsAddress, mux); err != nil {
+				glog.Fatalf("error starting metrics server: %v", err)
+			}
+		}()
 	}
 
+	/* register handlers */
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", clientAuthorizer.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mutate" {
+			http.NotFound(w, r)
+			return
+		}
+		wh.ServeHTTP(w, r)
+	})))
+
+	tlsConfig := &tls.Config{
+		ClientAuth:               webhook.GetClientAuth(*insecure),
+		ClientCAs:                clientCaPool.GetCertPool(),
+		PreferServerCipherSuites: true,
+		InsecureSkipVerify:       false,
+		GetCertificate:           keyPair.GetCertificateFunc(),
+	}
+	tlsPolicy.Apply(tlsConfig)
+	/* hand out the current client CA pool to every new connection */
+	tlsConfig.GetConfigForClient = clientCaPool.GetConfigForClientFunc(tlsConfig)
+
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", *address, *port),
+		Handler:           mux,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+		ReadHeaderTimeout: 1 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+
+	/* start serving */
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		glog.Fatalf("error starting web server: %v", err)
+	}
+	serverErr := make(chan error, 1)
 	go func() {
-		/* register handlers */
-		var httpServer *http.Server
+		serverErr <- httpServer.ServeTLS(listener, "", "")
+	}()
+	atomic.StoreInt32(&ready, 1)
+	glog.Infof("serving on %s", httpServer.Addr)
 
-		http.HandleFunc("/mutate", func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != "/mutate" {
-				http.NotFound(w, r)
-				return
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	/* watch the cert files and reload the key pair and client CAs if they are updated. */
+	watchers := map[string]*webhook.FileWatcher{
+		"certificate": webhook.NewFileWatcher([]string{*cert, *key}, *filePollInterval, keyPair.Reload),
+	}
+	if clientCAFiles := clientCaPool.GetCertPaths(); len(clientCAFiles) > 0 {
+		watchers["client CA"] = webhook.NewFileWatcher(clientCAFiles, *filePollInterval, clientCaPool.Reload)
+	}
+	if *configFile != "" {
+		watchers["configuration"] = webhook.NewFileWatcher([]string{*configFile}, *filePollInterval, reloadConfiguration)
+	}
+	for name, watcher := range watchers {
+		wg.Add(1)
+		go func(name string, watcher *webhook.FileWatcher) {
+			defer wg.Done()
+			if err := watcher.Run(ctx.Done()); err != nil {
+				glog.Fatalf("error watching %s files: %v", name, err)
 			}
-			if r.Method != http.MethodPost {
-				http.Error(w, "Invalid HTTP verb requested", 405)
+		}(name, watcher)
+	}
+
+	updateCustomizedInjections := func() {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(
+			ctx, userDefinedInjectionConfigMap, metav1.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				glog.Warningf("Failed to get configmap for user-defined injections: %v", err)
 				return
 			}
-			webhook.MutateHandler(w, r)
-		})
-
-		/* start serving */
-		httpServer = &http.Server{
-			Addr:              fmt.Sprintf("%s:%d", *address, *port),
-			ReadTimeout:       5 * time.Second,
-			WriteTimeout:      10 * time.Second,
-			MaxHeaderBytes:    1 << 20,
-			ReadHeaderTimeout: 1 * time.Second,
-			TLSConfig: &tls.Config{
-				ClientAuth:               webhook.GetClientAuth(*insecure),
-				MinVersion:               tls.VersionTLS12,
-				CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384},
-				ClientCAs:                clientCaPool.GetCertPool(),
-				PreferServerCipherSuites: true,
-				InsecureSkipVerify:       false,
-				CipherSuites: []uint16{
-					// tls 1.2
-					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-					// tls 1.3 configuration not supported
-				},
-				GetCertificate: keyPair.GetCertificateFunc(),
-			},
 		}
+		wh.SetCustomizedInjections(cm)
+	}
 
-		err := httpServer.ListenAndServeTLS("", "")
-		if err != nil {
-			glog.Fatalf("error starting web server: %v", err)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				updateCustomizedInjections()
+			}
 		}
 	}()
 
-	/* watch the cert file and restart http sever if the file updated. */
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		glog.Fatalf("error starting fsnotify watcher: %v", err)
-	}
-	defer watcher.Close()
-
-	certUpdated := false
-	keyUpdated := false
-
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	for {
-		watcher.Add(*cert)
-		watcher.Add(*key)
-
 		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				continue
-			}
-			glog.V(2).Infof("watcher event: %v", event)
-			mask := fsnotify.Create | fsnotify.Rename | fsnotify.Remove |
-				fsnotify.Write | fsnotify.Chmod
-			if (event.Op & mask) != 0 {
-				glog.V(2).Infof("modified file: %v", event.Name)
-				if event.Name == *cert {
-					certUpdated = true
-				}
-				if event.Name == *key {
-					keyUpdated = true
-				}
-				if keyUpdated && certUpdated {
-					if err := keyPair.Reload(); err != nil {
-						glog.Fatalf("Failed to reload certificate: %v", err)
-					}
-					certUpdated = false
-					keyUpdated = false
+		case err := <-serverErr:
+			glog.Fatalf("error serving: %v", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				glog.Infof("received %v, reloading configuration", sig)
+				if err := keyPair.Reload(); err != nil {
+					glog.Errorf("failed to reload certificate: %v", err)
 				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
+				clientCaPool.Reload()
+				reloadConfiguration()
+				updateCustomizedInjections()
 				continue
 			}
-			glog.Infof("watcher error: %v", err)
-		case <-time.After(30 * time.Second):
-			cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(
-				context.Background(), userDefinedInjectionConfigMap, metav1.GetOptions{})
-			if err != nil {
-				if !errors.IsNotFound(err) {
-					glog.Warningf("Failed to get configmap for user-defined injections: %v", err)
-					continue
-				}
+
+			glog.Infof("received %v, shutting down", sig)
+			/* stop receiving new requests before draining the in-flight ones */
+			atomic.StoreInt32(&ready, 0)
+			time.Sleep(*shutdownDelay)
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *shutdownGracePeriod)
+			if err := httpServer.Shutdown(shutdownCtx); err != nil {
+				glog.Errorf("error draining in-flight requests: %v", err)
 			}
-			webhook.SetCustomizedInjections(cm)
+			shutdownCancel()
+			cancel()
+			wg.Wait()
+			glog.Infof("shutdown complete")
+			glog.Flush()
+			return
 		}
 	}
 }
@@ -28,18 +28,51 @@ import (
 	"k8s.io/api/certificates/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
 )
 
 var (
-	clientset kubernetes.Interface
-	namespace string
-	prefix    string
+	clientset          kubernetes.Interface
+	dynamicClient      dynamic.Interface
+	namespace          string
+	prefix             string
+	reinvocationPolicy = arv1beta1.NeverReinvocationPolicy
+	timeoutSeconds     = int32(types.DefaultTimeoutSeconds)
+	failurePolicy      = arv1beta1.Ignore
+)
+
+const (
+	keyBitLength = 3072
+
+	certManagerGroup              = "cert-manager.io"
+	certManagerAPIVersion         = "cert-manager.io/v1"
+	certManagerInjectCAAnnotation = "cert-manager.io/inject-ca-from"
 )
 
-const keyBitLength = 3072
+var (
+	certificateResource = schema.GroupVersionResource{Group: certManagerGroup, Version: "v1", Resource: "certificates"}
+	issuerResource      = schema.GroupVersionResource{Group: certManagerGroup, Version: "v1", Resource: "issuers"}
+
+	/* how long and how often the installer checks if cert-manager issued the certificate */
+	certificateSecretTimeout  = 60 * time.Second
+	certificateSecretInterval = time.Second
+)
+
+func getServiceHosts() []string {
+	serviceName := strings.Join([]string{prefix, "service"}, "-")
+	return []string{
+		serviceName,
+		strings.Join([]string{serviceName, namespace}, "."),
+		strings.Join([]string{serviceName, namespace, "svc"}, "."),
+	}
+}
 
 func generateCSR() ([]byte, []byte, error) {
 	glog.Infof("generating Certificate Signing Request")
@@ -47,11 +80,7 @@ func generateCSR() ([]byte, []byte, error) {
 	certRequest := csr.New()
 	certRequest.KeyRequest = &csr.KeyRequest{A: "rsa", S: keyBitLength}
 	certRequest.CN = strings.Join([]string{serviceName, namespace, "svc"}, ".")
-	certRequest.Hosts = []string{
-		serviceName,
-		strings.Join([]string{serviceName, namespace}, "."),
-		strings.Join([]string{serviceName, namespace, "svc"}, "."),
-	}
+	certRequest.Hosts = getServiceHosts()
 	return csr.ParseRequest(certRequest)
 }
 
@@ -127,11 +156,87 @@ func writeToFile(certificate, key []byte, certFilename, keyFilename string) erro
 	return nil
 }
 
-func createMutatingWebhookConfiguration(certificate []byte) error {
+func createCertManagerIssuer(issuerName string) error {
+	removeCertManagerResourceIfExists(issuerResource, issuerName)
+	issuer := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": certManagerAPIVersion,
+			"kind":       "Issuer",
+			"metadata": map[string]interface{}{
+				"name":      issuerName,
+				"namespace": namespace,
+				"labels": map[string]interface{}{
+					"app": prefix,
+				},
+			},
+			"spec": map[string]interface{}{
+				"selfSigned": map[string]interface{}{},
+			},
+		},
+	}
+	_, err := dynamicClient.Resource(issuerResource).Namespace(namespace).Create(context.TODO(), issuer, metav1.CreateOptions{})
+	return err
+}
+
+func createCertManagerCertificate(certificateName, secretName, issuerKind, issuerName string) error {
+	removeCertManagerResourceIfExists(certificateResource, certificateName)
+	serviceName := strings.Join([]string{prefix, "service"}, "-")
+	dnsNames := []interface{}{}
+	for _, host := range getServiceHosts() {
+		dnsNames = append(dnsNames, host)
+	}
+	certificate := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": certManagerAPIVersion,
+			"kind":       "Certificate",
+			"metadata": map[string]interface{}{
+				"name":      certificateName,
+				"namespace": namespace,
+				"labels": map[string]interface{}{
+					"app": prefix,
+				},
+			},
+			"spec": map[string]interface{}{
+				"secretName": secretName,
+				"commonName": strings.Join([]string{serviceName, namespace, "svc"}, "."),
+				"dnsNames":   dnsNames,
+				"usages":     []interface{}{"digital signature", "key encipherment", "server auth"},
+				"privateKey": map[string]interface{}{
+					"algorithm": "RSA",
+					"size":      int64(keyBitLength),
+				},
+				"issuerRef": map[string]interface{}{
+					"group": certManagerGroup,
+					"kind":  issuerKind,
+					"name":  issuerName,
+				},
+			},
+		},
+	}
+	_, err := dynamicClient.Resource(certificateResource).Namespace(namespace).Create(context.TODO(), certificate, metav1.CreateOptions{})
+	return err
+}
+
+func waitForCertificateSecret(secretName string) error {
+	glog.Infof("waiting for cert-manager to issue secret %s...", secretName)
+	start := time.Now()
+	for range time.Tick(certificateSecretInterval) {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
+		if err == nil && len(secret.Data[corev1.TLSCertKey]) > 0 && len(secret.Data[corev1.TLSPrivateKeyKey]) > 0 {
+			return nil
+		}
+		if time.Since(start) > certificateSecretTimeout {
+			break
+		}
+	}
+
+	return errors.New("error getting certificate from cert-manager: request timed out - verify that cert-manager is running and the issuer is ready")
+}
+
+func createMutatingWebhookConfiguration(certificate []byte, annotations map[string]string) error {
 	configName := strings.Join([]string{prefix, "mutating-config"}, "-")
 	serviceName := strings.Join([]string{prefix, "service"}, "-")
 	removeMutatingWebhookIfExists(configName)
-	failurePolicy := arv1beta1.Ignore
 	path := "/mutate"
 	configuration := &arv1beta1.MutatingWebhookConfiguration{
 		ObjectMeta: metav1.ObjectMeta{
@@ -139,6 +244,7 @@ func createMutatingWebhookConfiguration(certificate []byte) error {
 			Labels: map[string]string{
 				"app": prefix,
 			},
+			Annotations: annotations,
 		},
 		Webhooks: []arv1beta1.MutatingWebhook{
 			arv1beta1.MutatingWebhook{
@@ -151,7 +257,9 @@ func createMutatingWebhookConfiguration(certificate []byte) error {
 						Path:      &path,
 					},
 				},
-				FailurePolicy: &failurePolicy,
+				FailurePolicy:      &failurePolicy,
+				ReinvocationPolicy: &reinvocationPolicy,
+				TimeoutSeconds:     &timeoutSeconds,
 				Rules: []arv1beta1.RuleWithOperations{
 					arv1beta1.RuleWithOperations{
 						Operations: []arv1beta1.OperationType{arv1beta1.Create},
@@ -169,6 +277,38 @@ func createMutatingWebhookConfiguration(certificate []byte) error {
 	return err
 }
 
+// SetTimeoutSeconds sets the time the API server waits for the webhook to answer
+func SetTimeoutSeconds(seconds int) error {
+	if seconds < 1 || seconds > types.MaxTimeoutSeconds {
+		return errors.Errorf("invalid timeout %d, it must be between 1 and %d seconds", seconds, types.MaxTimeoutSeconds)
+	}
+	timeoutSeconds = int32(seconds)
+	return nil
+}
+
+// SetFailurePolicy sets what the API server does with pods when the webhook can not be called
+// or does not answer in time: Ignore admits them unmutated, Fail rejects them
+func SetFailurePolicy(policy string) error {
+	switch arv1beta1.FailurePolicyType(policy) {
+	case arv1beta1.Ignore, arv1beta1.Fail:
+		failurePolicy = arv1beta1.FailurePolicyType(policy)
+		return nil
+	}
+	return errors.Errorf("invalid failure policy '%s'. Choose between %s and %s",
+		policy, arv1beta1.Ignore, arv1beta1.Fail)
+}
+
+// SetReinvocationPolicy sets the reinvocation policy of the mutating webhook, Never or IfNeeded
+func SetReinvocationPolicy(policy string) error {
+	switch arv1beta1.ReinvocationPolicyType(policy) {
+	case arv1beta1.NeverReinvocationPolicy, arv1beta1.IfNeededReinvocationPolicy:
+		reinvocationPolicy = arv1beta1.ReinvocationPolicyType(policy)
+		return nil
+	}
+	return errors.Errorf("invalid reinvocation policy '%s'. Choose between %s and %s",
+		policy, arv1beta1.NeverReinvocationPolicy, arv1beta1.IfNeededReinvocationPolicy)
+}
+
 func createService() error {
 	serviceName := strings.Join([]string{prefix, "service"}, "-")
 	removeServiceIfExists(serviceName)
@@ -219,6 +359,18 @@ func removeMutatingWebhookIfExists(configName string) {
 	}
 }
 
+func removeCertManagerResourceIfExists(resource schema.GroupVersionResource, name string) {
+	object, err := dynamicClient.Resource(resource).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if object != nil && err == nil {
+		glog.Infof("%s %s already exists, removing it first", resource.Resource, name)
+		err := dynamicClient.Resource(resource).Namespace(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil {
+			glog.Errorf("error trying to remove %s: %s", resource.Resource, err)
+		}
+		glog.Infof("%s %s removed", resource.Resource, name)
+	}
+}
+
 func removeSecretIfExists(secretName string) {
 	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
 	if secret != nil && err == nil {
@@ -231,8 +383,7 @@ func removeSecretIfExists(secretName string) {
 	}
 }
 
-// Install creates resources required by mutating admission webhook
-func Install(k8sNamespace, namePrefix string) {
+func setupClients(k8sNamespace, namePrefix string) {
 	/* setup Kubernetes API client */
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -242,9 +393,37 @@ func Install(k8sNamespace, namePrefix string) {
 	if err != nil {
 		glog.Fatalf("error setting up Kubernetes client: %s", err)
 	}
+	dynamicClient, err = dynamic.NewForConfig(config)
+	if err != nil {
+		glog.Fatalf("error setting up Kubernetes dynamic client: %s", err)
+	}
 
 	namespace = k8sNamespace
 	prefix = namePrefix
+}
+
+func createWebhookResources(certificate []byte, annotations map[string]string) error {
+	/* create webhook configurations */
+	err := createMutatingWebhookConfiguration(certificate, annotations)
+	if err != nil {
+		return errors.Wrap(err, "error creating mutating webhook configuration")
+	}
+	glog.Infof("mutating webhook configuration successfully created")
+
+	/* create service */
+	err = createService()
+	if err != nil {
+		return errors.Wrap(err, "error creating service")
+	}
+	glog.Infof("service successfully created")
+
+	glog.Infof("all resources created successfully")
+	return nil
+}
+
+// Install creates resources required by mutating admission webhook
+func Install(k8sNamespace, namePrefix string) {
+	setupClients(k8sNamespace, namePrefix)
 
 	/* generate CSR and private key */
 	csr, key, err := generateCSR()
@@ -266,19 +445,47 @@ func Install(k8sNamespace, namePrefix string) {
 	}
 	glog.Infof("certificate and key written to files")
 
-	/* create webhook configurations */
-	err = createMutatingWebhookConfiguration(certificate)
-	if err != nil {
-		glog.Fatalf("error creating mutating webhook configuration: %s", err)
+	if err := createWebhookResources(certificate, nil); err != nil {
+		glog.Fatal(err)
 	}
-	glog.Infof("mutating webhook configuration successfully created")
+}
 
-	/* create service */
-	err = createService()
-	if err != nil {
-		glog.Fatalf("error creating service: %s", err)
+// InstallWithCertManager creates resources required by mutating admission webhook
+// and leaves issuing of the serving certificate to cert-manager. The Kubernetes
+// CSR flow is skipped: a Certificate is created which cert-manager stores in the
+// '<prefix>-secret' Secret, and the CA bundle of the mutating webhook configuration
+// is injected by cert-manager's CA injector. If issuerName is empty, a self-signed
+// Issuer is created and used.
+func InstallWithCertManager(k8sNamespace, namePrefix, issuerKind, issuerName string) {
+	setupClients(k8sNamespace, namePrefix)
+	if err := installWithCertManager(issuerKind, issuerName); err != nil {
+		glog.Fatal(err)
 	}
-	glog.Infof("service successfully created")
+}
 
-	glog.Infof("all resources created successfully")
+func installWithCertManager(issuerKind, issuerName string) error {
+	if issuerName == "" {
+		issuerKind = "Issuer"
+		issuerName = strings.Join([]string{prefix, "issuer"}, "-")
+		if err := createCertManagerIssuer(issuerName); err != nil {
+			return errors.Wrap(err, "error creating cert-manager issuer")
+		}
+		glog.Infof("self-signed cert-manager issuer %s successfully created", issuerName)
+	}
+
+	certificateName := strings.Join([]string{prefix, "certificate"}, "-")
+	secretName := strings.Join([]string{prefix, "secret"}, "-")
+	if err := createCertManagerCertificate(certificateName, secretName, issuerKind, issuerName); err != nil {
+		return errors.Wrap(err, "error creating cert-manager certificate")
+	}
+	glog.Infof("cert-manager certificate %s successfully created", certificateName)
+
+	if err := waitForCertificateSecret(secretName); err != nil {
+		return errors.Wrap(err, "error getting signed certificate")
+	}
+	glog.Infof("signed certificate successfully issued to secret %s", secretName)
+
+	return createWebhookResources(nil, map[string]string{
+		certManagerInjectCAAnnotation: strings.Join([]string{namespace, certificateName}, "/"),
+	})
 }
@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package installer
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	arv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+var _ = Describe("Mutating webhook configuration", func() {
+	BeforeEach(func() {
+		clientset = fake.NewSimpleClientset()
+		namespace = "kube-system"
+		prefix = "nri"
+	})
+
+	AfterEach(func() {
+		Expect(SetFailurePolicy(string(arv1beta1.Ignore))).To(Succeed())
+		Expect(SetReinvocationPolicy(string(arv1beta1.NeverReinvocationPolicy))).To(Succeed())
+		Expect(SetTimeoutSeconds(types.DefaultTimeoutSeconds)).To(Succeed())
+	})
+
+	getWebhook := func() arv1beta1.MutatingWebhook {
+		Expect(createMutatingWebhookConfiguration([]byte("ca"), nil)).To(Succeed())
+		config, err := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(context.TODO(), "nri-mutating-config", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Webhooks).To(HaveLen(1))
+		return config.Webhooks[0]
+	}
+
+	It("should ignore webhook failures by default", func() {
+		Expect(*getWebhook().FailurePolicy).To(Equal(arv1beta1.Ignore))
+	})
+
+	It("should register the configured failure policy", func() {
+		Expect(SetFailurePolicy("Fail")).To(Succeed())
+		Expect(*getWebhook().FailurePolicy).To(Equal(arv1beta1.Fail))
+	})
+
+	It("should reject unknown failure policies", func() {
+		Expect(SetFailurePolicy("Deny")).NotTo(Succeed())
+		Expect(*getWebhook().FailurePolicy).To(Equal(arv1beta1.Ignore))
+	})
+
+	It("should never reinvoke the webhook by default", func() {
+		Expect(*getWebhook().ReinvocationPolicy).To(Equal(arv1beta1.NeverReinvocationPolicy))
+	})
+
+	It("should register the configured reinvocation policy", func() {
+		Expect(SetReinvocationPolicy("IfNeeded")).To(Succeed())
+		Expect(*getWebhook().ReinvocationPolicy).To(Equal(arv1beta1.IfNeededReinvocationPolicy))
+	})
+
+	It("should reject unknown reinvocation policies", func() {
+		Expect(SetReinvocationPolicy("Always")).NotTo(Succeed())
+		Expect(*getWebhook().ReinvocationPolicy).To(Equal(arv1beta1.NeverReinvocationPolicy))
+	})
+
+	It("should register the default timeout of the webhook configuration file", func() {
+		Expect(*getWebhook().TimeoutSeconds).To(Equal(types.NewNRIConfiguration().TimeoutSeconds))
+	})
+
+	It("should register the configured timeout", func() {
+		Expect(SetTimeoutSeconds(types.MaxTimeoutSeconds)).To(Succeed())
+		Expect(*getWebhook().TimeoutSeconds).To(Equal(int32(types.MaxTimeoutSeconds)))
+	})
+
+	It("should reject timeouts the API server does not accept", func() {
+		Expect(SetTimeoutSeconds(0)).NotTo(Succeed())
+		Expect(SetTimeoutSeconds(types.MaxTimeoutSeconds + 1)).NotTo(Succeed())
+		Expect(*getWebhook().TimeoutSeconds).To(Equal(int32(types.DefaultTimeoutSeconds)))
+	})
+})
+
+var _ = Describe("cert-manager installation", func() {
+	BeforeEach(func() {
+		clientset = fake.NewSimpleClientset()
+		dynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+		namespace = "kube-system"
+		prefix = "nri"
+		certificateSecretTimeout = 3 * time.Second
+		certificateSecretInterval = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		certificateSecretTimeout = 60 * time.Second
+		certificateSecretInterval = time.Second
+	})
+
+	issueSecret := func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "nri-secret"},
+			Data:       map[string][]byte{corev1.TLSCertKey: []byte("cert"), corev1.TLSPrivateKeyKey: []byte("key")},
+		}
+		_, err := clientset.CoreV1().Secrets("kube-system").Create(context.TODO(), secret, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	getCertManagerResource := func(resource schema.GroupVersionResource, name string) *unstructured.Unstructured {
+		object, err := dynamicClient.Resource(resource).Namespace("kube-system").Get(context.TODO(), name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return object
+	}
+
+	specField := func(object *unstructured.Unstructured, field string) interface{} {
+		value, found, err := unstructured.NestedFieldCopy(object.Object, "spec", field)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		return value
+	}
+
+	It("should create a self-signed issuer, the certificate and the webhook configuration", func() {
+		issueSecret()
+		Expect(installWithCertManager("Issuer", "")).To(Succeed())
+
+		issuer := getCertManagerResource(issuerResource, "nri-issuer")
+		Expect(issuer.GetKind()).To(Equal("Issuer"))
+		Expect(specField(issuer, "selfSigned")).To(Equal(map[string]interface{}{}))
+
+		certificate := getCertManagerResource(certificateResource, "nri-certificate")
+		Expect(specField(certificate, "secretName")).To(Equal("nri-secret"))
+		Expect(specField(certificate, "dnsNames")).To(Equal(
+			[]interface{}{"nri-service", "nri-service.kube-system", "nri-service.kube-system.svc"}))
+		Expect(specField(certificate, "issuerRef")).To(Equal(map[string]interface{}{
+			"group": "cert-manager.io",
+			"kind":  "Issuer",
+			"name":  "nri-issuer",
+		}))
+
+		config, err := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(context.TODO(), "nri-mutating-config", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Annotations).To(Equal(map[string]string{"cert-manager.io/inject-ca-from": "kube-system/nri-certificate"}))
+		Expect(config.Webhooks[0].ClientConfig.CABundle).To(BeEmpty())
+		_, err = clientset.CoreV1().Services("kube-system").Get(context.TODO(), "nri-service", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should use the given issuer", func() {
+		issueSecret()
+		Expect(installWithCertManager("ClusterIssuer", "ca-issuer")).To(Succeed())
+
+		_, err := dynamicClient.Resource(issuerResource).Namespace("kube-system").Get(context.TODO(), "nri-issuer", metav1.GetOptions{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		Expect(specField(getCertManagerResource(certificateResource, "nri-certificate"), "issuerRef")).To(Equal(map[string]interface{}{
+			"group": "cert-manager.io",
+			"kind":  "ClusterIssuer",
+			"name":  "ca-issuer",
+		}))
+	})
+
+	It("should replace an existing certificate", func() {
+		Expect(createCertManagerCertificate("nri-certificate", "old-secret", "Issuer", "old-issuer")).To(Succeed())
+		Expect(createCertManagerCertificate("nri-certificate", "nri-secret", "ClusterIssuer", "ca-issuer")).To(Succeed())
+		certificate := getCertManagerResource(certificateResource, "nri-certificate")
+		Expect(specField(certificate, "secretName")).To(Equal("nri-secret"))
+		Expect(specField(certificate, "issuerRef")).To(HaveKeyWithValue("name", "ca-issuer"))
+	})
+
+	It("should fail if cert-manager does not issue the certificate in time", func() {
+		certificateSecretTimeout = 50 * time.Millisecond
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "nri-secret"},
+			Data:       map[string][]byte{corev1.TLSCertKey: []byte("cert")},
+		}
+		_, err := clientset.CoreV1().Secrets("kube-system").Create(context.TODO(), secret, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(waitForCertificateSecret("nri-secret")).To(MatchError(ContainSubstring("request timed out")))
+		Expect(installWithCertManager("Issuer", "")).NotTo(Succeed())
+		_, err = clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(context.TODO(), "nri-mutating-config", metav1.GetOptions{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+})
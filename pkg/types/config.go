@@ -0,0 +1,346 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	NRIConfigurationAPIVersion = "nri.k8s.cni.cncf.io/v1alpha1"
+	NRIConfigurationKind       = "NRIConfiguration"
+	DefaultResourceNameKey     = "k8s.v1.cni.cncf.io/resourceName"
+	// DefaultTimeoutSeconds is the default webhook timeout of the API server
+	DefaultTimeoutSeconds = 10
+	// MaxTimeoutSeconds is the largest webhook timeout accepted by the API server
+	MaxTimeoutSeconds = 30
+	// DefaultMaxConcurrentNetworkLookups bounds the parallel lookups of the networks of a pod
+	DefaultMaxConcurrentNetworkLookups = 8
+	// DefaultMaxResourceCount is the largest resource count a pod may request for an attachment
+	DefaultMaxResourceCount = 4
+	// DefaultHugepagesMountPath is where the hugepages of networks are mounted, followed by -<size>
+	DefaultHugepagesMountPath = "/hugepages"
+	// DefaultDownwardAPIVolumeName is the name of the Downward API volume added to pods
+	DefaultDownwardAPIVolumeName = "podnetinfo"
+	// DefaultDeviceInfoPath is the device-info directory of the Network Plumbing WG specification
+	DefaultDeviceInfoPath = "/var/run/k8s.cni.cncf.io/devinfo"
+	// DownwardAPIContainersAnnotation lists the containers of a pod mounting the Downward API
+	// volume when the volume is configured with DownwardAPIContainersAnnotated
+	DownwardAPIContainersAnnotation = "network-resources-injector.k8s.cni.cncf.io/downward-api-containers"
+)
+
+// DownwardAPIContainers selects the containers mounting the Downward API volume
+type DownwardAPIContainers string
+
+const (
+	// DownwardAPIContainersAll mounts the volume into all containers and init containers
+	DownwardAPIContainersAll DownwardAPIContainers = "All"
+	// DownwardAPIContainersResources mounts the volume into the container receiving the network
+	// resources and the containers whose resources are exposed in the volume
+	DownwardAPIContainersResources DownwardAPIContainers = "ResourceContainers"
+	// DownwardAPIContainersAnnotated mounts the volume into the containers listed in the
+	// DownwardAPIContainersAnnotation pod annotation
+	DownwardAPIContainersAnnotated DownwardAPIContainers = "Annotated"
+)
+
+// DeviceInfoVolume configures the mount of the device-info directory. Device plugins and CNIs
+// write the details of the devices allocated to pods into its dp and cni directories.
+type DeviceInfoVolume struct {
+	// Enabled mounts the directory read-only into the containers receiving network resources
+	Enabled bool `json:"enabled,omitempty"`
+	// HostPath is the device-info directory of the nodes, /var/run/k8s.cni.cncf.io/devinfo by default
+	HostPath string `json:"hostPath,omitempty"`
+	// MountPath is where the directory is mounted in the containers, the host path by default
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+// DownwardAPIVolume configures the volume exposing the pod information to the containers
+type DownwardAPIVolume struct {
+	// Name of the volume, podnetinfo by default
+	Name string `json:"name,omitempty"`
+	// MountPath is where the volume is mounted in the containers, /etc/podnetinfo by default
+	MountPath string `json:"mountPath,omitempty"`
+	// ReadOnly mounts the volume read-only, true by default
+	ReadOnly *bool `json:"readOnly,omitempty"`
+	// Containers selects the containers mounting the volume, All by default
+	Containers DownwardAPIContainers `json:"containers,omitempty"`
+	// Annotations lists the pod annotations projected into files of their own, next to
+	// the file holding all annotations. See AnnotationPath for the names of the files.
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// FailurePolicy defines how pods are admitted when some of their networks can not be resolved
+type FailurePolicy string
+
+const (
+	// FailurePolicyDeny rejects the pod
+	FailurePolicyDeny FailurePolicy = "Deny"
+	// FailurePolicyAllowUnmutated admits the pod without any mutation
+	FailurePolicyAllowUnmutated FailurePolicy = "AllowUnmutated"
+	// FailurePolicyAllowPartial admits the pod mutated for the networks which could be resolved
+	FailurePolicyAllowPartial FailurePolicy = "AllowPartial"
+)
+
+// NRIConfiguration holds the settings of the webhook which can be changed at runtime.
+// It is read from the file given with the --config flag, e.g. a mounted ConfigMap:
+//
+//   apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+//   kind: NRIConfiguration
+//   resourceNameKeys:
+//   - k8s.v1.cni.cncf.io/resourceName
+//   honorExistingResources: true
+//   injectHugepageDownAPI: true
+//   mutators:
+//   - network-resources
+//   - node-selector
+//   failurePolicy: Deny
+//   namespaceFailurePolicies:
+//     best-effort: AllowPartial
+//   timeoutSeconds: 10
+//   maxConcurrentNetworkLookups: 8
+//   maxResourceCount: 4
+//   hugepagesMountPath: /hugepages
+//   downwardAPIResources:
+//   - cpu
+//   - memory
+//   downwardAPIVolume:
+//     name: podnetinfo
+//     mountPath: /etc/podnetinfo
+//     readOnly: true
+//     containers: All
+//     annotations:
+//     - k8s.v1.cni.cncf.io/network-status
+//   deviceInfo:
+//     enabled: true
+//     hostPath: /var/run/k8s.cni.cncf.io/devinfo
+//     mountPath: /var/run/k8s.cni.cncf.io/devinfo
+type NRIConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ResourceNameKeys are the NetworkAttachmentDefinition annotations holding the name
+	// of the resource requested by a network
+	ResourceNameKeys []string `json:"resourceNameKeys,omitempty"`
+	// HonorExistingResources adds the network resources to the requests and limits already
+	// present in the pod spec instead of overwriting them
+	HonorExistingResources bool `json:"honorExistingResources,omitempty"`
+	// InjectHugepageDownAPI exposes the hugepage requests and limits of the containers
+	// through the Downward API
+	InjectHugepageDownAPI bool `json:"injectHugepageDownAPI,omitempty"`
+	// Mutators lists the enabled mutators, all registered mutators are enabled if empty.
+	// The mutators always run in registration order.
+	Mutators []string `json:"mutators,omitempty"`
+	// FailurePolicy applies when networks of a pod can not be resolved, Deny by default
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+	// NamespaceFailurePolicies overrides the failure policy for pods of some namespaces
+	NamespaceFailurePolicies map[string]FailurePolicy `json:"namespaceFailurePolicies,omitempty"`
+	// TimeoutSeconds must match the timeoutSeconds of the MutatingWebhookConfiguration.
+	// API calls made while mutating a pod have to complete within this time.
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+	// MaxConcurrentNetworkLookups bounds the number of network attachment definitions
+	// looked up in parallel for a pod
+	MaxConcurrentNetworkLookups int `json:"maxConcurrentNetworkLookups,omitempty"`
+	// MaxResourceCount is the largest resourceCount a network selection of a pod may set
+	// to override the resource count of the network attachment definition
+	MaxResourceCount int64 `json:"maxResourceCount,omitempty"`
+	// HugepagesMountPath is the path the hugepages required by networks are mounted at,
+	// followed by the page size, e.g. /hugepages-1Gi
+	HugepagesMountPath string `json:"hugepagesMountPath,omitempty"`
+	// DownwardAPIResources lists the resources of the containers exposed in the Downward API
+	// volume: cpu, memory, ephemeral-storage and network-resources
+	DownwardAPIResources []string `json:"downwardAPIResources,omitempty"`
+	// DownwardAPIVolume configures the Downward API volume
+	DownwardAPIVolume DownwardAPIVolume `json:"downwardAPIVolume,omitempty"`
+	// DeviceInfo configures the mount of the device-info directory
+	DeviceInfo DeviceInfoVolume `json:"deviceInfo,omitempty"`
+}
+
+// NewNRIConfiguration returns a configuration with default values
+func NewNRIConfiguration() *NRIConfiguration {
+	config := &NRIConfiguration{}
+	config.SetDefaults()
+	return config
+}
+
+// SetDefaults fills unset fields with their default values
+func (c *NRIConfiguration) SetDefaults() {
+	if c.APIVersion == "" {
+		c.APIVersion = NRIConfigurationAPIVersion
+	}
+	if c.Kind == "" {
+		c.Kind = NRIConfigurationKind
+	}
+	if len(c.ResourceNameKeys) == 0 {
+		c.ResourceNameKeys = []string{DefaultResourceNameKey}
+	}
+	if c.FailurePolicy == "" {
+		c.FailurePolicy = FailurePolicyDeny
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = DefaultTimeoutSeconds
+	}
+	if c.MaxConcurrentNetworkLookups == 0 {
+		c.MaxConcurrentNetworkLookups = DefaultMaxConcurrentNetworkLookups
+	}
+	if c.MaxResourceCount == 0 {
+		c.MaxResourceCount = DefaultMaxResourceCount
+	}
+	if c.HugepagesMountPath == "" {
+		c.HugepagesMountPath = DefaultHugepagesMountPath
+	}
+	if c.DownwardAPIVolume.Name == "" {
+		c.DownwardAPIVolume.Name = DefaultDownwardAPIVolumeName
+	}
+	if c.DownwardAPIVolume.MountPath == "" {
+		c.DownwardAPIVolume.MountPath = DownwardAPIMountPath
+	}
+	if c.DownwardAPIVolume.ReadOnly == nil {
+		readOnly := true
+		c.DownwardAPIVolume.ReadOnly = &readOnly
+	}
+	if c.DownwardAPIVolume.Containers == "" {
+		c.DownwardAPIVolume.Containers = DownwardAPIContainersAll
+	}
+	if c.DeviceInfo.HostPath == "" {
+		c.DeviceInfo.HostPath = DefaultDeviceInfoPath
+	}
+	if c.DeviceInfo.MountPath == "" {
+		c.DeviceInfo.MountPath = c.DeviceInfo.HostPath
+	}
+}
+
+// Validate checks that the configuration is complete and consistent
+func (c *NRIConfiguration) Validate() error {
+	if c.APIVersion != NRIConfigurationAPIVersion {
+		return fmt.Errorf("unsupported apiVersion '%s', expected '%s'", c.APIVersion, NRIConfigurationAPIVersion)
+	}
+	if c.Kind != NRIConfigurationKind {
+		return fmt.Errorf("unsupported kind '%s', expected '%s'", c.Kind, NRIConfigurationKind)
+	}
+	if len(c.ResourceNameKeys) == 0 {
+		return fmt.Errorf("resourceNameKeys can not be empty")
+	}
+	for _, key := range c.ResourceNameKeys {
+		if strings.TrimSpace(key) == "" {
+			return fmt.Errorf("resourceNameKeys can not contain empty keys")
+		}
+	}
+	if err := validateFailurePolicy(c.FailurePolicy); err != nil {
+		return fmt.Errorf("failurePolicy: %v", err)
+	}
+	for namespace, policy := range c.NamespaceFailurePolicies {
+		if err := validateFailurePolicy(policy); err != nil {
+			return fmt.Errorf("namespaceFailurePolicies[%s]: %v", namespace, err)
+		}
+	}
+	if c.TimeoutSeconds < 1 || c.TimeoutSeconds > MaxTimeoutSeconds {
+		return fmt.Errorf("timeoutSeconds must be between 1 and %d, got %d", MaxTimeoutSeconds, c.TimeoutSeconds)
+	}
+	if c.MaxConcurrentNetworkLookups < 1 {
+		return fmt.Errorf("maxConcurrentNetworkLookups must be positive, got %d", c.MaxConcurrentNetworkLookups)
+	}
+	if c.MaxResourceCount < 1 {
+		return fmt.Errorf("maxResourceCount must be positive, got %d", c.MaxResourceCount)
+	}
+	if !strings.HasPrefix(c.HugepagesMountPath, "/") {
+		return fmt.Errorf("hugepagesMountPath must be an absolute path, got '%s'", c.HugepagesMountPath)
+	}
+	if errs := validation.IsDNS1123Label(c.DownwardAPIVolume.Name); len(errs) > 0 {
+		return fmt.Errorf("downwardAPIVolume.name '%s' is invalid: %s", c.DownwardAPIVolume.Name, strings.Join(errs, ", "))
+	}
+	if !strings.HasPrefix(c.DownwardAPIVolume.MountPath, "/") {
+		return fmt.Errorf("downwardAPIVolume.mountPath must be an absolute path, got '%s'", c.DownwardAPIVolume.MountPath)
+	}
+	switch c.DownwardAPIVolume.Containers {
+	case DownwardAPIContainersAll, DownwardAPIContainersResources, DownwardAPIContainersAnnotated:
+	default:
+		return fmt.Errorf("downwardAPIVolume.containers: unsupported selection '%s', expected %s, %s or %s",
+			c.DownwardAPIVolume.Containers, DownwardAPIContainersAll, DownwardAPIContainersResources, DownwardAPIContainersAnnotated)
+	}
+	paths := map[string]string{AnnotationsPath: "", LabelsPath: "", NetworkResourcesPath: ""}
+	for _, key := range c.DownwardAPIVolume.Annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("downwardAPIVolume.annotations: invalid key '%s': %s", key, strings.Join(errs, ", "))
+		}
+		path := AnnotationPath(key)
+		if other, exists := paths[path]; exists {
+			if other == "" {
+				return fmt.Errorf("downwardAPIVolume.annotations: file '%s' of annotation '%s' is reserved", path, key)
+			}
+			return fmt.Errorf("downwardAPIVolume.annotations: annotations '%s' and '%s' would both be projected into file '%s'", other, key, path)
+		}
+		paths[path] = key
+	}
+	if !strings.HasPrefix(c.DeviceInfo.HostPath, "/") {
+		return fmt.Errorf("deviceInfo.hostPath must be an absolute path, got '%s'", c.DeviceInfo.HostPath)
+	}
+	if !strings.HasPrefix(c.DeviceInfo.MountPath, "/") {
+		return fmt.Errorf("deviceInfo.mountPath must be an absolute path, got '%s'", c.DeviceInfo.MountPath)
+	}
+	listed := make(map[string]bool)
+	for _, name := range c.DownwardAPIResources {
+		switch name {
+		case DownwardAPIResourceCPU, DownwardAPIResourceMemory, DownwardAPIResourceEphemeralStorage, DownwardAPIResourceNetwork:
+		default:
+			return fmt.Errorf("downwardAPIResources: unsupported resource '%s', expected %s, %s, %s or %s", name,
+				DownwardAPIResourceCPU, DownwardAPIResourceMemory, DownwardAPIResourceEphemeralStorage, DownwardAPIResourceNetwork)
+		}
+		if listed[name] {
+			return fmt.Errorf("downwardAPIResources: resource '%s' is listed more than once", name)
+		}
+		listed[name] = true
+	}
+	return nil
+}
+
+func validateFailurePolicy(policy FailurePolicy) error {
+	switch policy {
+	case FailurePolicyDeny, FailurePolicyAllowUnmutated, FailurePolicyAllowPartial:
+		return nil
+	}
+	return fmt.Errorf("unsupported policy '%s', expected %s, %s or %s", policy,
+		FailurePolicyDeny, FailurePolicyAllowUnmutated, FailurePolicyAllowPartial)
+}
+
+// FailurePolicyFor returns the failure policy for pods of a namespace
+func (c *NRIConfiguration) FailurePolicyFor(namespace string) FailurePolicy {
+	if policy, ok := c.NamespaceFailurePolicies[namespace]; ok {
+		return policy
+	}
+	return c.FailurePolicy
+}
+
+// DeepCopy returns a copy of the configuration sharing no data with the original
+func (c *NRIConfiguration) DeepCopy() *NRIConfiguration {
+	out := *c
+	out.ResourceNameKeys = append([]string(nil), c.ResourceNameKeys...)
+	out.Mutators = append([]string(nil), c.Mutators...)
+	out.DownwardAPIResources = append([]string(nil), c.DownwardAPIResources...)
+	out.DownwardAPIVolume.Annotations = append([]string(nil), c.DownwardAPIVolume.Annotations...)
+	if c.DownwardAPIVolume.ReadOnly != nil {
+		readOnly := *c.DownwardAPIVolume.ReadOnly
+		out.DownwardAPIVolume.ReadOnly = &readOnly
+	}
+	if c.NamespaceFailurePolicies != nil {
+		out.NamespaceFailurePolicies = make(map[string]FailurePolicy, len(c.NamespaceFailurePolicies))
+		for k, v := range c.NamespaceFailurePolicies {
+			out.NamespaceFailurePolicies[k] = v
+		}
+	}
+	return &out
+}
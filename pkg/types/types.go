@@ -14,13 +14,139 @@
 
 package types
 
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	DownwardAPIMountPath = "/etc/podnetinfo"
+	AnnotationsPath      = "annotations"
+	LabelsPath           = "labels"
+	EnvNameContainerName = "CONTAINER_NAME"
+)
+
+// The Downward API files of hugepages of any size are named hugepages_<size>_request_<container>
+// and hugepages_<size>_limit_<container>, the size without the trailing i. The 1Gi and 2Mi paths
+// are kept for reference.
 const (
-	DownwardAPIMountPath   = "/etc/podnetinfo"
-	AnnotationsPath        = "annotations"
-	LabelsPath             = "labels"
-	EnvNameContainerName   = "CONTAINER_NAME"
 	Hugepages1GRequestPath = "hugepages_1G_request"
 	Hugepages2MRequestPath = "hugepages_2M_request"
 	Hugepages1GLimitPath   = "hugepages_1G_limit"
 	Hugepages2MLimitPath   = "hugepages_2M_limit"
 )
+
+// Files of the cpu, memory and ephemeral-storage requests and limits of a container are
+// named <resource>_request_<container> and <resource>_limit_<container>, with the dashes of
+// the resource name replaced by underscores, e.g. cpu_limit_app or ephemeral_storage_request_app.
+// CPU is given in millicores, memory and ephemeral storage in MiB like hugepages. The
+// network resources injected into the pod are found in the NetworkResourcesPath file as the
+// InjectionRecord.
+const (
+	RequestPathSuffix    = "_request"
+	LimitPathSuffix      = "_limit"
+	NetworkResourcesPath = "network_resources"
+)
+
+// AnnotationPath returns the name of the Downward API file holding a single pod annotation,
+// which is the name of the annotation key without its prefix, e.g. network-status for
+// k8s.v1.cni.cncf.io/network-status
+func AnnotationPath(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+// Resources which can be exposed in the Downward API volume
+const (
+	DownwardAPIResourceCPU              = "cpu"
+	DownwardAPIResourceMemory           = "memory"
+	DownwardAPIResourceEphemeralStorage = "ephemeral-storage"
+	DownwardAPIResourceNetwork          = "network-resources"
+)
+
+// InjectionRecordAnnotation is the pod annotation holding the InjectionRecord of
+// the last mutation, which allows mutating a pod again without injecting twice
+const InjectionRecordAnnotation = "network-resources-injector.k8s.cni.cncf.io/injected"
+
+// InjectionRecord describes what was injected into a pod
+type InjectionRecord struct {
+	// Resources maps the network resources added to the pod to their total count
+	Resources map[string]int64 `json:"resources,omitempty"`
+	// Networks lists the resources contributed by each network selection
+	Networks []NetworkInjection `json:"networks,omitempty"`
+	// NodeSelector lists the node selector keys required by the networks
+	NodeSelector []string `json:"nodeSelector,omitempty"`
+	// OverheadRequests holds the resource overhead of the networks added to the requests
+	OverheadRequests corev1.ResourceList `json:"overheadRequests,omitempty"`
+	// OverheadLimits holds what was added to the limits for the resource overhead
+	OverheadLimits corev1.ResourceList `json:"overheadLimits,omitempty"`
+	// Hugepages holds the hugepages of the networks added to the requests and limits
+	Hugepages corev1.ResourceList `json:"hugepages,omitempty"`
+	// HugepageVolumes maps the hugepages of the networks to the name of the volume mounting them
+	HugepageVolumes map[string]string `json:"hugepageVolumes,omitempty"`
+	// DownwardAPIVolume is the name of the Downward API volume added to the pod
+	DownwardAPIVolume string `json:"downwardAPIVolume,omitempty"`
+	// DeviceInfoVolume is the name of the device-info volume added to the pod
+	DeviceInfoVolume string `json:"deviceInfoVolume,omitempty"`
+	// Tolerations lists the tolerations of the networks added to the pod
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+// NetworkInjection describes a resource injected for a network selection
+type NetworkInjection struct {
+	// Network is the network attachment definition as namespace/name
+	Network string `json:"network"`
+	// Interface is the interface name requested in the network selection
+	Interface string `json:"interface,omitempty"`
+	// Resource is the name of the injected resource
+	Resource string `json:"resource"`
+	// Count is the number of resources injected for the network selection
+	Count int64 `json:"count"`
+	// Container is the name of the container receiving the resource
+	Container string `json:"container"`
+}
+
+// IsEmpty returns true if nothing was injected
+func (r *InjectionRecord) IsEmpty() bool {
+	return len(r.Resources) == 0 && len(r.Networks) == 0 && len(r.NodeSelector) == 0 &&
+		len(r.OverheadRequests) == 0 && len(r.OverheadLimits) == 0 && len(r.Hugepages) == 0 &&
+		len(r.HugepageVolumes) == 0 &&
+		r.DownwardAPIVolume == "" &&
+		r.DeviceInfoVolume == "" &&
+		len(r.Tolerations) == 0
+}
+
+// DeepCopy returns a copy of the record sharing no data with the original
+func (r *InjectionRecord) DeepCopy() *InjectionRecord {
+	out := &InjectionRecord{
+		Networks:          append([]NetworkInjection(nil), r.Networks...),
+		NodeSelector:      append([]string(nil), r.NodeSelector...),
+		DownwardAPIVolume: r.DownwardAPIVolume,
+		DeviceInfoVolume:  r.DeviceInfoVolume,
+	}
+	if r.Resources != nil {
+		out.Resources = make(map[string]int64, len(r.Resources))
+		for k, v := range r.Resources {
+			out.Resources[k] = v
+		}
+	}
+	if r.OverheadRequests != nil {
+		out.OverheadRequests = r.OverheadRequests.DeepCopy()
+	}
+	if r.OverheadLimits != nil {
+		out.OverheadLimits = r.OverheadLimits.DeepCopy()
+	}
+	if r.Hugepages != nil {
+		out.Hugepages = r.Hugepages.DeepCopy()
+	}
+	if r.HugepageVolumes != nil {
+		out.HugepageVolumes = make(map[string]string, len(r.HugepageVolumes))
+		for k, v := range r.HugepageVolumes {
+			out.HugepageVolumes[k] = v
+		}
+	}
+	for i := range r.Tolerations {
+		out.Tolerations = append(out.Tolerations, *r.Tolerations[i].DeepCopy())
+	}
+	return out
+}
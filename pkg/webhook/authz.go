@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// clientAuthorizer restricts which verified client certificates may call the webhook
+type clientAuthorizer struct {
+	commonNames   map[string]bool
+	sans          map[string]bool
+	organizations map[string]bool
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// NewClientAuthorizer creates an authorizer allowing client certificates whose common name,
+// any subject alternative name or any organization is in the given allowlists. If all
+// allowlists are empty, every client certificate accepted by the TLS layer is allowed.
+func NewClientAuthorizer(commonNames, sans, organizations []string) *clientAuthorizer {
+	return &clientAuthorizer{
+		commonNames:   toSet(commonNames),
+		sans:          toSet(sans),
+		organizations: toSet(organizations),
+	}
+}
+
+func (a *clientAuthorizer) enabled() bool {
+	return len(a.commonNames) > 0 || len(a.sans) > 0 || len(a.organizations) > 0
+}
+
+// Authorized checks the identity of a client certificate against the allowlists
+func (a *clientAuthorizer) Authorized(cert *x509.Certificate) bool {
+	if !a.enabled() {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+	if a.commonNames[cert.Subject.CommonName] {
+		return true
+	}
+	for _, org := range cert.Subject.Organization {
+		if a.organizations[org] {
+			return true
+		}
+	}
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if a.sans[san] {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a handler which answers with 403 Forbidden to clients whose certificate is not allowed
+func (a *clientAuthorizer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.enabled() {
+			var cert *x509.Certificate
+			if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+				cert = req.TLS.PeerCertificates[0]
+			}
+			if !a.Authorized(cert) {
+				reason := "no_certificate"
+				if cert != nil {
+					reason = "identity"
+					glog.Warningf("rejecting request from %s: client certificate '%s' is not allowed", req.RemoteAddr, cert.Subject.String())
+				} else {
+					glog.Warningf("rejecting request from %s: no client certificate", req.RemoteAddr)
+				}
+				unauthorizedRequestsTotal.WithLabelValues(reason).Inc()
+				http.Error(w, "client certificate is not allowed to call the webhook", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Client authorization", func() {
+	apiServerCert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   "kube-apiserver",
+			Organization: []string{"system:masters"},
+		},
+		DNSNames:    []string{"apiserver.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	DescribeTable("Authorizing a client certificate",
+		func(cns, sans, orgs []string, cert *x509.Certificate, allowed bool) {
+			Expect(NewClientAuthorizer(cns, sans, orgs).Authorized(cert)).To(Equal(allowed))
+		},
+		Entry("no allowlist", nil, nil, nil, apiServerCert, true),
+		Entry("allowed common name", []string{"kube-apiserver"}, nil, nil, apiServerCert, true),
+		Entry("allowed DNS name", nil, []string{"apiserver.example.com"}, nil, apiServerCert, true),
+		Entry("allowed IP address", nil, []string{"10.0.0.1"}, nil, apiServerCert, true),
+		Entry("allowed organization", nil, nil, []string{"system:masters"}, apiServerCert, true),
+		Entry("identity not in allowlists", []string{"other"}, []string{"other.example.com"}, []string{"other"}, apiServerCert, false),
+		Entry("no certificate", []string{"kube-apiserver"}, nil, nil, nil, false),
+	)
+
+	Describe("Wrapping a handler", func() {
+		var next http.Handler
+		BeforeEach(func() {
+			next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+		})
+
+		It("should pass allowed clients to the handler", func() {
+			req := httptest.NewRequest("POST", "https://fakewebhook/mutate", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{apiServerCert}}
+			w := httptest.NewRecorder()
+			NewClientAuthorizer([]string{"kube-apiserver"}, nil, nil).Wrap(next).ServeHTTP(w, req)
+			Expect(w.Result().StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should reject other clients with 403", func() {
+			req := httptest.NewRequest("POST", "https://fakewebhook/mutate", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{apiServerCert}}
+			w := httptest.NewRecorder()
+			NewClientAuthorizer([]string{"other"}, nil, nil).Wrap(next).ServeHTTP(w, req)
+			Expect(w.Result().StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("should reject clients without a certificate with 403", func() {
+			req := httptest.NewRequest("POST", "https://fakewebhook/mutate", nil)
+			w := httptest.NewRecorder()
+			NewClientAuthorizer([]string{"kube-apiserver"}, nil, nil).Wrap(next).ServeHTTP(w, req)
+			Expect(w.Result().StatusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+})
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+// Configuration returns the configuration used by new requests. It must not be modified.
+func (wh *Webhook) Configuration() *types.NRIConfiguration {
+	return wh.config.Load().(*types.NRIConfiguration)
+}
+
+func getConfiguration() *types.NRIConfiguration {
+	return defaultWebhook.Configuration()
+}
+
+func (wh *Webhook) updateConfiguration(update func(*types.NRIConfiguration)) {
+	wh.configMutex.Lock()
+	defer wh.configMutex.Unlock()
+	config := wh.Configuration().DeepCopy()
+	update(config)
+	wh.config.Store(config)
+}
+
+// LoadConfiguration reads a configuration file, fills in default values and validates it
+func LoadConfiguration(path string) (*types.NRIConfiguration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading configuration file '%s'", path)
+	}
+	config := &types.NRIConfiguration{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrapf(err, "error parsing configuration file '%s'", path)
+	}
+	config.SetDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid configuration file '%s'", path)
+	}
+	return config, nil
+}
+
+// SetConfiguration validates a configuration and atomically replaces the one used by new requests
+func SetConfiguration(config *types.NRIConfiguration) error {
+	return defaultWebhook.SetConfiguration(config)
+}
+
+/* validateConfiguration also checks the settings depending on the webhook, e.g. the mutator names */
+func (wh *Webhook) validateConfiguration(config *types.NRIConfiguration) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return wh.mutators.validate(config.Mutators)
+}
+
+// SetConfiguration validates a configuration and atomically replaces the one used by new requests
+func (wh *Webhook) SetConfiguration(config *types.NRIConfiguration) error {
+	if err := wh.validateConfiguration(config); err != nil {
+		return err
+	}
+	wh.configMutex.Lock()
+	defer wh.configMutex.Unlock()
+	wh.config.Store(config.DeepCopy())
+	return nil
+}
+
+// ReloadConfiguration loads the configuration file, or the default configuration if path
+// is empty, applies the overrides and replaces the current configuration. The current
+// configuration is kept if any of these steps fails.
+func ReloadConfiguration(path string, overrides func(*types.NRIConfiguration)) error {
+	return defaultWebhook.ReloadConfiguration(path, overrides)
+}
+
+// ReloadConfiguration loads the configuration file, or the default configuration if path
+// is empty, applies the overrides and replaces the current configuration. The current
+// configuration is kept if any of these steps fails.
+func (wh *Webhook) ReloadConfiguration(path string, overrides func(*types.NRIConfiguration)) error {
+	config := types.NewNRIConfiguration()
+	if path != "" {
+		var err error
+		if config, err = LoadConfiguration(path); err != nil {
+			glog.Errorf("failed to load configuration, keeping the current one: %v", err)
+			configReloadsTotal.WithLabelValues("failure").Inc()
+			return err
+		}
+	}
+	if overrides != nil {
+		overrides(config)
+	}
+	if err := wh.SetConfiguration(config); err != nil {
+		glog.Errorf("invalid configuration, keeping the current one: %v", err)
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+	glog.Infof("configuration loaded: %+v", *config)
+	configReloadsTotal.WithLabelValues("success").Inc()
+	configLastReloadSuccess.Set(float64(time.Now().Unix()))
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+var _ = Describe("Configuration", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nri-config")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		Expect(SetConfiguration(types.NewNRIConfiguration())).To(Succeed())
+	})
+
+	writeConfig := func(content string) string {
+		path := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return path
+	}
+
+	DescribeTable("Loading a configuration file",
+		func(content string, out *types.NRIConfiguration, shouldFail bool) {
+			config, err := LoadConfiguration(writeConfig(content))
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config).To(Equal(out))
+		},
+		Entry("defaults", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+`, types.NewNRIConfiguration(), false),
+		Entry("all fields", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+resourceNameKeys:
+- example.com/resourceName
+honorExistingResources: true
+injectHugepageDownAPI: true
+failurePolicy: AllowUnmutated
+namespaceFailurePolicies:
+  best-effort: AllowPartial
+timeoutSeconds: 5
+maxConcurrentNetworkLookups: 4
+maxResourceCount: 2
+hugepagesMountPath: /dev/hugepages
+downwardAPIResources:
+- cpu
+- network-resources
+downwardAPIVolume:
+  name: netinfo
+  mountPath: /var/run/netinfo
+  readOnly: false
+  containers: Annotated
+  annotations:
+  - k8s.v1.cni.cncf.io/network-status
+deviceInfo:
+  enabled: true
+  hostPath: /run/devinfo
+  mountPath: /var/run/k8s.cni.cncf.io/devinfo
+`, &types.NRIConfiguration{
+			TypeMeta:                    types.NewNRIConfiguration().TypeMeta,
+			ResourceNameKeys:            []string{"example.com/resourceName"},
+			HonorExistingResources:      true,
+			InjectHugepageDownAPI:       true,
+			FailurePolicy:               types.FailurePolicyAllowUnmutated,
+			NamespaceFailurePolicies:    map[string]types.FailurePolicy{"best-effort": types.FailurePolicyAllowPartial},
+			TimeoutSeconds:              5,
+			MaxConcurrentNetworkLookups: 4,
+			MaxResourceCount:            2,
+			HugepagesMountPath:          "/dev/hugepages",
+			DownwardAPIResources:        []string{"cpu", "network-resources"},
+			DownwardAPIVolume: types.DownwardAPIVolume{
+				Name:        "netinfo",
+				MountPath:   "/var/run/netinfo",
+				ReadOnly:    new(bool),
+				Containers:  types.DownwardAPIContainersAnnotated,
+				Annotations: []string{"k8s.v1.cni.cncf.io/network-status"},
+			},
+			DeviceInfo: types.DeviceInfoVolume{
+				Enabled:   true,
+				HostPath:  "/run/devinfo",
+				MountPath: types.DefaultDeviceInfoPath,
+			},
+		}, false),
+		Entry("unsupported version", `
+apiVersion: nri.k8s.cni.cncf.io/v2
+kind: NRIConfiguration
+`, nil, true),
+		Entry("unknown field", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+honorResources: true
+`, nil, true),
+		Entry("unsupported failure policy", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+failurePolicy: Ignore
+`, nil, true),
+		Entry("unsupported namespace failure policy", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+namespaceFailurePolicies:
+  default: Fail
+`, nil, true),
+		Entry("timeout above the API server limit", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+timeoutSeconds: 31
+`, nil, true),
+		Entry("negative lookup concurrency", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+maxConcurrentNetworkLookups: -1
+`, nil, true),
+		Entry("relative hugepages mount path", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+hugepagesMountPath: hugepages
+`, nil, true),
+		Entry("invalid Downward API volume name", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIVolume:
+  name: Pod_Net_Info
+`, nil, true),
+		Entry("relative Downward API mount path", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIVolume:
+  mountPath: podnetinfo
+`, nil, true),
+		Entry("unsupported Downward API container selection", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIVolume:
+  containers: First
+`, nil, true),
+		Entry("invalid Downward API annotation", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIVolume:
+  annotations:
+  - "example.com/network status"
+`, nil, true),
+		Entry("Downward API annotations projected into the same file", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIVolume:
+  annotations:
+  - k8s.v1.cni.cncf.io/networks
+  - example.com/networks
+`, nil, true),
+		Entry("Downward API annotation projected into a reserved file", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIVolume:
+  annotations:
+  - example.com/labels
+`, nil, true),
+		Entry("relative device-info host path", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+deviceInfo:
+  hostPath: devinfo
+`, nil, true),
+		Entry("duplicate Downward API resource", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIResources:
+- cpu
+- memory
+- cpu
+`, nil, true),
+		Entry("unsupported Downward API resource", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+downwardAPIResources:
+- example.com/nic
+`, nil, true),
+		Entry("empty resource name key", `
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+resourceNameKeys:
+- ""
+`, nil, true),
+	)
+
+	Describe("Reloading the configuration", func() {
+		It("should apply the overrides on top of the file", func() {
+			path := writeConfig(`
+apiVersion: nri.k8s.cni.cncf.io/v1alpha1
+kind: NRIConfiguration
+honorExistingResources: true
+`)
+			Expect(ReloadConfiguration(path, func(config *types.NRIConfiguration) {
+				config.InjectHugepageDownAPI = true
+			})).To(Succeed())
+			Expect(getConfiguration().HonorExistingResources).To(BeTrue())
+			Expect(getConfiguration().InjectHugepageDownAPI).To(BeTrue())
+		})
+
+		It("should keep the current configuration if the file is invalid", func() {
+			SetHonorExistingResources(true)
+			Expect(ReloadConfiguration(writeConfig("kind: Pod"), nil)).NotTo(Succeed())
+			Expect(getConfiguration().HonorExistingResources).To(BeTrue())
+		})
+	})
+
+	Describe("Setting resource name keys", func() {
+		It("should replace the previous keys", func() {
+			Expect(SetResourceNameKeys("a/b, c/d")).To(Succeed())
+			Expect(SetResourceNameKeys("e/f")).To(Succeed())
+			Expect(getConfiguration().ResourceNameKeys).To(Equal([]string{"e/f"}))
+		})
+	})
+})
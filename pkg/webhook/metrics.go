@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "network_resources_injector"
+
+var (
+	clientCAReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_ca_reloads_total",
+		Help:      "Number of client CA pool reloads, partitioned by result.",
+	}, []string{"result"})
+	clientCALastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_ca_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful client CA pool reload.",
+	})
+	configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of configuration reloads, partitioned by result.",
+	}, []string{"result"})
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+	mutateDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutate_duration_seconds",
+		Help:      "Time spent handling mutation requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	networkResolutionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "network_resolution_failures_total",
+		Help:      "Number of network selections whose network attachment definition could not be resolved.",
+	}, []string{"reason"})
+	unauthorizedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unauthorized_requests_total",
+		Help:      "Number of requests rejected because of the client certificate identity, partitioned by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(clientCAReloadsTotal, clientCALastReloadSuccess,
+		configReloadsTotal, configLastReloadSuccess, mutateDurationSeconds, networkResolutionFailuresTotal, unauthorizedRequestsTotal)
+}
+
+// MetricsHandler returns the HTTP handler exposing webhook metrics in Prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
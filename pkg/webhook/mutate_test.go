@@ -0,0 +1,1165 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	pkgerrors "github.com/pkg/errors"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+/* fakeNetAttachDefGetter serves network attachment definitions from memory */
+type fakeNetAttachDefGetter struct {
+	sync.Mutex
+	nads map[string]*cniv1.NetworkAttachmentDefinition
+	/* errs are returned for the first failures[key] calls, or always if failures has no key */
+	errs     map[string]error
+	failures map[string]int
+	calls    int
+}
+
+func newFakeNetAttachDefGetter(nads ...*cniv1.NetworkAttachmentDefinition) *fakeNetAttachDefGetter {
+	getter := &fakeNetAttachDefGetter{
+		nads:     make(map[string]*cniv1.NetworkAttachmentDefinition),
+		errs:     make(map[string]error),
+		failures: make(map[string]int),
+	}
+	for _, nad := range nads {
+		getter.nads[nad.Namespace+"/"+nad.Name] = nad
+	}
+	return getter
+}
+
+func (g *fakeNetAttachDefGetter) Get(ctx context.Context, namespace, name string) (*cniv1.NetworkAttachmentDefinition, error) {
+	g.Lock()
+	defer g.Unlock()
+	g.calls++
+	key := namespace + "/" + name
+	if err, ok := g.errs[key]; ok {
+		failures, limited := g.failures[key]
+		if !limited {
+			return nil, err
+		}
+		if failures > 0 {
+			g.failures[key] = failures - 1
+			return nil, err
+		}
+	}
+	nad, ok := g.nads[key]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Group: "k8s.cni.cncf.io", Resource: "network-attachment-definitions"}, name)
+	}
+	return nad.DeepCopy(), nil
+}
+
+func newNetAttachDef(namespace, name string, annotations map[string]string) *cniv1.NetworkAttachmentDefinition {
+	return &cniv1.NetworkAttachmentDefinition{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+	}
+}
+
+/* sendAdmissionReview posts a pod to the webhook and returns the admission response */
+func sendAdmissionReview(handler http.Handler, pod *corev1.Pod) *v1beta1.AdmissionResponse {
+	raw, err := json.Marshal(pod)
+	Expect(err).NotTo(HaveOccurred())
+	review := v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:    "fake-uid",
+			Object: runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	Expect(err).NotTo(HaveOccurred())
+
+	req := httptest.NewRequest("POST", "https://fakewebhook/mutate", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	Expect(w.Code).To(Equal(http.StatusOK))
+
+	out := v1beta1.AdmissionReview{}
+	Expect(json.Unmarshal(w.Body.Bytes(), &out)).To(Succeed())
+	Expect(out.Response).NotTo(BeNil())
+	return out.Response
+}
+
+/* decodePatch returns the JSON patch of an admission response */
+func decodePatch(resp *v1beta1.AdmissionResponse) []jsonPatchOperation {
+	var patch []jsonPatchOperation
+	if len(resp.Patch) > 0 {
+		Expect(json.Unmarshal(resp.Patch, &patch)).To(Succeed())
+	}
+	return patch
+}
+
+/* applyPatch returns the pod with the patch of an admission response applied */
+func applyPatch(pod *corev1.Pod, resp *v1beta1.AdmissionResponse) *corev1.Pod {
+	if len(resp.Patch) == 0 {
+		return pod
+	}
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	Expect(err).NotTo(HaveOccurred())
+	raw, err := json.Marshal(pod)
+	Expect(err).NotTo(HaveOccurred())
+	patched, err := patch.Apply(raw)
+	Expect(err).NotTo(HaveOccurred())
+	out := &corev1.Pod{}
+	Expect(json.Unmarshal(patched, out)).To(Succeed())
+	return out
+}
+
+func newPodWithNetworks(networks string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "default",
+			Annotations: map[string]string{networksAnnotationKey: networks},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test", Image: "test"}},
+		},
+	}
+}
+
+var _ = Describe("Webhook instance", func() {
+	var getter *fakeNetAttachDefGetter
+	var wh *Webhook
+
+	BeforeEach(func() {
+		getter = newFakeNetAttachDefGetter(
+			newNetAttachDef("default", "net-a", map[string]string{"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a"}),
+			newNetAttachDef("default", "net-b", map[string]string{"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-b"}),
+		)
+		var err error
+		wh, err = NewWebhook(Options{NetworkAttachmentDefinitions: getter})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject invalid configurations", func() {
+		config := types.NewNRIConfiguration()
+		config.ResourceNameKeys = []string{""}
+		_, err := NewWebhook(Options{Config: config})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only accept POST requests", func() {
+		req := httptest.NewRequest("GET", "https://fakewebhook/mutate", nil)
+		w := httptest.NewRecorder()
+		wh.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("should request the resource of an attached network", func() {
+		resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(getter.calls).To(Equal(1))
+		Expect(decodePatch(resp)).To(ContainElement(jsonPatchOperation{
+			Operation: "add",
+			Path:      "/spec/containers/0/resources/requests",
+			Value:     map[string]interface{}{"example.com/nic-a": "1"},
+		}))
+	})
+
+	It("should produce a patch which applies to the admitted pod", func() {
+		pod := newPodWithNetworks("net-a")
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name: "sidecar",
+			Env:  []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+		})
+		pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+
+		mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+		Expect(mutated.Spec.Containers[0].Resources.Limits).To(HaveKey(corev1.ResourceName("example.com/nic-a")))
+		Expect(mutated.Spec.Volumes).To(HaveLen(2))
+		Expect(mutated.Spec.Volumes[0].Name).To(Equal("data"))
+		Expect(mutated.Spec.Volumes[1].Name).To(Equal(types.DefaultDownwardAPIVolumeName))
+		for _, container := range mutated.Spec.Containers {
+			Expect(container.VolumeMounts).To(HaveLen(1))
+		}
+		Expect(mutated.Spec.Containers[1].Env).To(Equal(pod.Spec.Containers[1].Env))
+	})
+
+	It("should keep a podnetinfo volume defined by the user", func() {
+		pod := newPodWithNetworks("net-a")
+		pod.Spec.Volumes = []corev1.Volume{{Name: types.DefaultDownwardAPIVolumeName}}
+		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: types.DefaultDownwardAPIVolumeName, MountPath: "/tmp"}}
+
+		resp := sendAdmissionReview(wh, pod)
+		Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("'podnetinfo-1'"))
+		mutated := applyPatch(pod, resp)
+		Expect(mutated.Spec.Volumes).To(HaveLen(2))
+		Expect(mutated.Spec.Volumes[0]).To(Equal(pod.Spec.Volumes[0]))
+		Expect(mutated.Spec.Volumes[1].Name).To(Equal("podnetinfo-1"))
+		Expect(mutated.Spec.Volumes[1].DownwardAPI).NotTo(BeNil())
+		Expect(mutated.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{
+			{Name: types.DefaultDownwardAPIVolumeName, MountPath: "/tmp"},
+			{Name: "podnetinfo-1", ReadOnly: true, MountPath: types.DownwardAPIMountPath},
+		}))
+
+		resp = sendAdmissionReview(wh, mutated)
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patch).To(BeEmpty())
+	})
+
+	It("should not patch a pod which has been mutated already", func() {
+		mutated := applyPatch(newPodWithNetworks("net-a"), sendAdmissionReview(wh, newPodWithNetworks("net-a")))
+		resp := sendAdmissionReview(wh, mutated)
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patch).To(BeEmpty())
+	})
+
+	It("should reject pods attached to unknown networks", func() {
+		resp := sendAdmissionReview(wh, newPodWithNetworks("net-unknown"))
+		Expect(resp.Allowed).To(BeFalse())
+	})
+
+	It("should not share state with other instances", func() {
+		Expect(wh.SetConfiguration(types.NewNRIConfiguration())).To(Succeed())
+		wh.updateConfiguration(func(config *types.NRIConfiguration) {
+			config.HonorExistingResources = true
+		})
+		Expect(wh.Configuration().HonorExistingResources).To(BeTrue())
+		Expect(defaultWebhook.Configuration().HonorExistingResources).To(BeFalse())
+	})
+
+	Context("Reinvocation", func() {
+		nicA := corev1.ResourceName("example.com/nic-a")
+		nicB := corev1.ResourceName("example.com/nic-b")
+
+		BeforeEach(func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.HonorExistingResources = true
+			})
+		})
+
+		newPodWithRequests := func(networks string) *corev1.Pod {
+			pod := newPodWithNetworks(networks)
+			pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{nicA: resource.MustParse("2")}
+			pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{nicA: resource.MustParse("2")}
+			return pod
+		}
+
+		It("should record the injected resources", func() {
+			mutated := applyPatch(newPodWithRequests("net-a"), sendAdmissionReview(wh, newPodWithRequests("net-a")))
+			Expect(getInjectionRecord(mutated)).To(Equal(&types.InjectionRecord{
+				Resources: map[string]int64{"example.com/nic-a": 1},
+				Networks: []types.NetworkInjection{
+					{Network: "default/net-a", Resource: "example.com/nic-a", Count: 1, Container: "test"},
+				},
+				DownwardAPIVolume: types.DefaultDownwardAPIVolumeName,
+			}))
+			Expect(mutated.Spec.Containers[0].Resources.Requests[nicA]).To(Equal(resource.MustParse("3")))
+		})
+
+		It("should not add honored resources twice", func() {
+			mutated := applyPatch(newPodWithRequests("net-a"), sendAdmissionReview(wh, newPodWithRequests("net-a")))
+			resp := sendAdmissionReview(wh, mutated)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patch).To(BeEmpty())
+		})
+
+		It("should replace the recorded resources if the networks changed", func() {
+			mutated := applyPatch(newPodWithRequests("net-a"), sendAdmissionReview(wh, newPodWithRequests("net-a")))
+			mutated.Annotations[networksAnnotationKey] = "net-b"
+
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.Containers[0].Resources.Requests[nicA]).To(Equal(resource.MustParse("2")))
+			Expect(mutated.Spec.Containers[0].Resources.Limits[nicA]).To(Equal(resource.MustParse("2")))
+			Expect(mutated.Spec.Containers[0].Resources.Requests[nicB]).To(Equal(resource.MustParse("1")))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.Resources).To(Equal(map[string]int64{"example.com/nic-b": 1}))
+		})
+	})
+
+	Context("Injection record", func() {
+		BeforeEach(func() {
+			getter.nads["default/net-zone"] = newNetAttachDef("default", "net-zone", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a",
+				nodeSelectorKey:                   "zone=a",
+			})
+		})
+
+		It("should describe the resources of every network selection", func() {
+			pod := newPodWithNetworks(`[{"name": "net-a", "interface": "net1"}, {"name": "net-zone"}, {"name": "net-b"}]`)
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(getInjectionRecord(mutated)).To(Equal(&types.InjectionRecord{
+				Resources: map[string]int64{"example.com/nic-a": 2, "example.com/nic-b": 1},
+				Networks: []types.NetworkInjection{
+					{Network: "default/net-a", Interface: "net1", Resource: "example.com/nic-a", Count: 1, Container: "test"},
+					{Network: "default/net-zone", Resource: "example.com/nic-a", Count: 1, Container: "test"},
+					{Network: "default/net-b", Resource: "example.com/nic-b", Count: 1, Container: "test"},
+				},
+				NodeSelector:      []string{"zone"},
+				DownwardAPIVolume: types.DefaultDownwardAPIVolumeName,
+			}))
+		})
+
+		It("should remove node labels which are no longer required", func() {
+			pod := newPodWithNetworks("net-zone")
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(mutated.Spec.NodeSelector).To(HaveKeyWithValue("zone", "a"))
+
+			mutated.Annotations[networksAnnotationKey] = "net-a"
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.NodeSelector).NotTo(HaveKey("zone"))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.NodeSelector).To(BeEmpty())
+		})
+
+		It("should keep node labels set by the user", func() {
+			pod := newPodWithNetworks("net-zone")
+			pod.Spec.NodeSelector = map[string]string{"zone": "a"}
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.NodeSelector).To(BeEmpty())
+
+			mutated.Annotations[networksAnnotationKey] = "net-a"
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.NodeSelector).To(Equal(map[string]string{"zone": "a"}))
+		})
+	})
+
+	Context("Failure policy", func() {
+		nadResource := schema.GroupResource{Group: "k8s.cni.cncf.io", Resource: "network-attachment-definitions"}
+
+		BeforeEach(func() {
+			getter.errs["default/net-forbidden"] = errors.NewForbidden(nadResource, "net-forbidden", fmt.Errorf("denied"))
+		})
+
+		setPolicy := func(policy types.FailurePolicy, namespacePolicies map[string]types.FailurePolicy) {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.FailurePolicy = policy
+				config.NamespaceFailurePolicies = namespacePolicies
+			})
+		}
+
+		It("should deny the pod by default and classify the error", func() {
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-a, net-unknown, net-forbidden"))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("network 'default/net-unknown' could not be resolved (NotFound)"))
+			Expect(resp.Result.Message).To(ContainSubstring("network 'default/net-forbidden' could not be resolved (Forbidden)"))
+		})
+
+		It("should admit the pod without mutation", func() {
+			setPolicy(types.FailurePolicyAllowUnmutated, nil)
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-a, net-unknown"))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patch).To(BeEmpty())
+			Expect(resp.Result.Message).To(ContainSubstring("(NotFound)"))
+			Expect(resp.AuditAnnotations).To(HaveKey(warningsAuditAnnotationKey))
+		})
+
+		It("should mutate the pod for the resolved networks", func() {
+			setPolicy(types.FailurePolicyAllowPartial, nil)
+			pod := newPodWithNetworks("net-a, net-unknown")
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("default/net-unknown"))
+			mutated := applyPatch(pod, resp)
+			Expect(mutated.Spec.Containers[0].Resources.Requests).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("1"),
+			}))
+		})
+
+		It("should apply the policy of the pod namespace", func() {
+			setPolicy(types.FailurePolicyAllowPartial, map[string]types.FailurePolicy{"default": types.FailurePolicyDeny})
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-a, net-unknown"))
+			Expect(resp.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("Resource count", func() {
+		BeforeEach(func() {
+			getter.nads["default/net-bond"] = newNetAttachDef("default", "net-bond", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName":  "example.com/nic-a",
+				"k8s.v1.cni.cncf.io/resourceCount": "2",
+			})
+		})
+
+		requestsOf := func(resp *v1beta1.AdmissionResponse, pod *corev1.Pod) corev1.ResourceList {
+			Expect(resp.Allowed).To(BeTrue())
+			return applyPatch(pod, resp).Spec.Containers[0].Resources.Requests
+		}
+
+		It("should request the count declared by the net-attach-def for each attachment", func() {
+			pod := newPodWithNetworks("net-bond, net-bond, net-a")
+			Expect(requestsOf(sendAdmissionReview(wh, pod), pod)).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("5"),
+			}))
+		})
+
+		It("should let network selections override the count", func() {
+			pod := newPodWithNetworks(`[{"name": "net-bond", "resourceCount": 3}, {"name": "net-a"}]`)
+			Expect(requestsOf(sendAdmissionReview(wh, pod), pod)).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("4"),
+			}))
+		})
+
+		It("should deny counts above the configured maximum", func() {
+			resp := sendAdmissionReview(wh, newPodWithNetworks(`[{"name": "net-bond", "resourceCount": 5}]`))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("exceeds the maximum of 4"))
+		})
+
+		It("should deny counts above the maximum whatever the failure policy", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.FailurePolicy = types.FailurePolicyAllowPartial
+			})
+			resp := sendAdmissionReview(wh, newPodWithNetworks(`[{"name": "net-bond", "resourceCount": 5}, {"name": "net-a"}]`))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("exceeds the maximum of 4"))
+		})
+
+		It("should deny invalid overrides instead of failing the request", func() {
+			resp := sendAdmissionReview(wh, newPodWithNetworks(`[{"name": "net-bond", "resourceCount": 0}]`))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("resourceCount"))
+		})
+
+		It("should deny invalid counts declared by the net-attach-def", func() {
+			getter.nads["default/net-bond"].Annotations["k8s.v1.cni.cncf.io/resourceCount"] = "two"
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-bond"))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("(Invalid)"))
+		})
+	})
+
+	Context("Multiple resources", func() {
+		requestsOf := func(pod *corev1.Pod) (corev1.ResourceList, *v1beta1.AdmissionResponse) {
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.Allowed).To(BeTrue())
+			return applyPatch(pod, resp).Spec.Containers[0].Resources.Requests, resp
+		}
+
+		It("should request the listed resources together with the resource name", func() {
+			getter.nads["default/net-rdma"] = newNetAttachDef("default", "net-rdma", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName":  "example.com/nic-a",
+				"k8s.v1.cni.cncf.io/resourceCount": "2",
+				"k8s.v1.cni.cncf.io/resources":     "example.com/rdma, example.com/queue=4",
+			})
+			requests, _ := requestsOf(newPodWithNetworks("net-rdma, net-rdma"))
+			Expect(requests).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("4"),
+				"example.com/rdma":  resource.MustParse("2"),
+				"example.com/queue": resource.MustParse("8"),
+			}))
+		})
+
+		It("should only use the first configured resource name key", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.ResourceNameKeys = []string{"k8s.v1.cni.cncf.io/resourceName", "example.com/resourceName"}
+			})
+			getter.nads["default/net-two-keys"] = newNetAttachDef("default", "net-two-keys", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a",
+				"example.com/resourceName":        "example.com/nic-b",
+			})
+			requests, resp := requestsOf(newPodWithNetworks("net-two-keys"))
+			Expect(requests).To(Equal(corev1.ResourceList{"example.com/nic-a": resource.MustParse("1")}))
+			Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("ignoring resource 'example.com/nic-b'"))
+		})
+
+		It("should deny resources requested twice by a network", func() {
+			getter.nads["default/net-twice"] = newNetAttachDef("default", "net-twice", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a",
+				"k8s.v1.cni.cncf.io/resources":    "example.com/nic-a=2",
+			})
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-twice"))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("(Invalid)"))
+		})
+	})
+
+	Context("Resource overhead", func() {
+		BeforeEach(func() {
+			getter.nads["default/net-dpdk"] = newNetAttachDef("default", "net-dpdk", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName":     "example.com/nic-a",
+				"k8s.v1.cni.cncf.io/resourceOverhead": "cpu=1, memory=512Mi, hugepages-1Gi=1Gi",
+			})
+		})
+
+		newPodWithResources := func(requests, limits corev1.ResourceList) *corev1.Pod {
+			pod := newPodWithNetworks("net-dpdk, net-dpdk")
+			pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{Requests: requests, Limits: limits}
+			return pod
+		}
+
+		It("should add the overhead of each attachment to the requests, the limits which are set and the hugepages limits", func() {
+			pod := newPodWithResources(
+				corev1.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1Gi")},
+				corev1.ResourceList{"cpu": resource.MustParse("2")},
+			)
+			resources := applyPatch(pod, sendAdmissionReview(wh, pod)).Spec.Containers[0].Resources
+			Expect(resources.Requests).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("2"),
+				"cpu":               resource.MustParse("3"),
+				"memory":            resource.MustParse("2Gi"),
+				"hugepages-1Gi":     resource.MustParse("2Gi"),
+			}))
+			Expect(resources.Limits).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("2"),
+				"cpu":               resource.MustParse("4"),
+				"hugepages-1Gi":     resource.MustParse("2Gi"),
+			}))
+		})
+
+		It("should add the overhead to the limit of requests which default to it", func() {
+			pod := newPodWithResources(nil, corev1.ResourceList{"memory": resource.MustParse("1Gi")})
+			resources := applyPatch(pod, sendAdmissionReview(wh, pod)).Spec.Containers[0].Resources
+			Expect(resources.Requests).To(HaveKeyWithValue(corev1.ResourceMemory, resource.MustParse("2Gi")))
+			Expect(resources.Limits).To(HaveKeyWithValue(corev1.ResourceMemory, resource.MustParse("2Gi")))
+		})
+
+		It("should keep Guaranteed pods Guaranteed", func() {
+			resources := corev1.ResourceList{"cpu": resource.MustParse("2"), "memory": resource.MustParse("1Gi")}
+			pod := newPodWithResources(resources, resources.DeepCopy())
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod)).Spec.Containers[0].Resources
+			Expect(mutated.Limits).To(Equal(mutated.Requests))
+			Expect(mutated.Requests).To(HaveKeyWithValue(corev1.ResourceCPU, resource.MustParse("4")))
+		})
+
+		It("should not set limits of Burstable pods", func() {
+			pod := newPodWithResources(
+				corev1.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1Gi")},
+				corev1.ResourceList{"cpu": resource.MustParse("1")},
+			)
+			resources := applyPatch(pod, sendAdmissionReview(wh, pod)).Spec.Containers[0].Resources
+			Expect(resources.Requests).To(HaveKeyWithValue(corev1.ResourceMemory, resource.MustParse("2Gi")))
+			Expect(resources.Limits).NotTo(HaveKey(corev1.ResourceMemory))
+			Expect(resources.Limits).To(HaveKeyWithValue(corev1.ResourceCPU, resource.MustParse("3")))
+		})
+
+		It("should not add the overhead to pods without containers", func() {
+			pc := &PodContext{
+				Pod:      &corev1.Pod{},
+				Config:   wh.Configuration(),
+				Overhead: corev1.ResourceList{"cpu": resource.MustParse("1")},
+				record:   &types.InjectionRecord{},
+			}
+			warnings, err := mutateResourceOverhead(context.TODO(), pc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
+			Expect(pc.record.OverheadRequests).To(BeEmpty())
+		})
+
+		It("should not add the overhead twice when mutating the pod again", func() {
+			pod := newPodWithResources(corev1.ResourceList{"cpu": resource.MustParse("1")}, nil)
+			once := applyPatch(pod, sendAdmissionReview(wh, pod))
+			twice := applyPatch(once, sendAdmissionReview(wh, once))
+			Expect(twice.Spec.Containers[0].Resources).To(Equal(once.Spec.Containers[0].Resources))
+
+			twice.Annotations[networksAnnotationKey] = "net-a"
+			removed := applyPatch(twice, sendAdmissionReview(wh, twice)).Spec.Containers[0].Resources
+			Expect(removed.Requests).To(Equal(corev1.ResourceList{
+				"example.com/nic-a": resource.MustParse("1"),
+				"cpu":               resource.MustParse("1"),
+			}))
+			Expect(removed.Limits).To(Equal(corev1.ResourceList{"example.com/nic-a": resource.MustParse("1")}))
+		})
+	})
+
+	Context("Network hugepages", func() {
+		BeforeEach(func() {
+			getter.nads["default/net-hp"] = newNetAttachDef("default", "net-hp", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a",
+				"k8s.v1.cni.cncf.io/hugepages":    "1Gi=2Gi",
+			})
+		})
+
+		It("should request, mount and expose the hugepages of each attachment", func() {
+			pod := newPodWithNetworks("net-hp, net-hp")
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			container := mutated.Spec.Containers[0]
+			Expect(container.Resources.Requests).To(HaveKeyWithValue(corev1.ResourceName("hugepages-1Gi"), resource.MustParse("4Gi")))
+			Expect(container.Resources.Limits).To(HaveKeyWithValue(corev1.ResourceName("hugepages-1Gi"), resource.MustParse("4Gi")))
+			Expect(container.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "hugepages-1gi", MountPath: "/hugepages-1Gi"}))
+			Expect(container.Env).To(ContainElement(corev1.EnvVar{Name: "CONTAINER_NAME", Value: "test"}))
+			Expect(mutated.Spec.Volumes).To(ContainElement(corev1.Volume{
+				Name: "hugepages-1gi",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{Medium: "HugePages-1Gi"},
+				},
+			}))
+			var paths []string
+			for _, volume := range mutated.Spec.Volumes {
+				if volume.DownwardAPI != nil {
+					for _, item := range volume.DownwardAPI.Items {
+						paths = append(paths, item.Path)
+					}
+				}
+			}
+			Expect(paths).To(ContainElement("hugepages_1G_request_test"))
+			Expect(paths).To(ContainElement("hugepages_1G_limit_test"))
+		})
+
+		It("should not expose the same hugepages twice with injectHugepageDownAPI", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.InjectHugepageDownAPI = true
+			})
+			pod := newPodWithNetworks("net-hp")
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			for _, volume := range mutated.Spec.Volumes {
+				if volume.DownwardAPI != nil {
+					Expect(volume.DownwardAPI.Items).To(HaveLen(3))
+				}
+			}
+		})
+
+		It("should remove hugepages which are no longer required", func() {
+			pod := newPodWithNetworks("net-hp")
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.Containers[0].Resources.Requests).To(HaveKeyWithValue(corev1.ResourceName("hugepages-1Gi"), resource.MustParse("2Gi")))
+
+			mutated.Annotations[networksAnnotationKey] = "net-a"
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.Containers[0].Resources.Requests).NotTo(HaveKey(corev1.ResourceName("hugepages-1Gi")))
+			Expect(mutated.Spec.Containers[0].VolumeMounts).NotTo(ContainElement(WithTransform(func(mount corev1.VolumeMount) string {
+				return mount.Name
+			}, Equal("hugepages-1gi"))))
+			Expect(mutated.Spec.Volumes).NotTo(ContainElement(WithTransform(func(volume corev1.Volume) string {
+				return volume.Name
+			}, Equal("hugepages-1gi"))))
+		})
+
+		It("should keep a volume of the user named like the hugepages volume", func() {
+			pod := newPodWithNetworks("net-hp")
+			pod.Spec.Volumes = []corev1.Volume{{Name: "hugepages-1gi"}}
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("hugepages volume is named 'hugepages-1gi-1'"))
+			mutated := applyPatch(pod, resp)
+			Expect(mutated.Spec.Volumes).To(ContainElement(pod.Spec.Volumes[0]))
+			Expect(mutated.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "hugepages-1gi-1", MountPath: "/hugepages-1Gi"}))
+
+			resp = sendAdmissionReview(wh, mutated)
+			Expect(resp.Patch).To(BeEmpty())
+			mutated.Annotations[networksAnnotationKey] = "net-a"
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.Volumes).To(ContainElement(pod.Spec.Volumes[0]))
+			Expect(mutated.Spec.Volumes).NotTo(ContainElement(WithTransform(func(volume corev1.Volume) string {
+				return volume.Name
+			}, Equal("hugepages-1gi-1"))))
+		})
+
+		It("should not mount the hugepages over another volume", func() {
+			pod := newPodWithNetworks("net-hp")
+			pod.Spec.Volumes = []corev1.Volume{{Name: "pages"}}
+			pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "pages", MountPath: "/hugepages-1Gi"}}
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("already mounts volume 'pages' at /hugepages-1Gi"))
+			mutated := applyPatch(pod, resp)
+			Expect(mutated.Spec.Containers[0].Resources.Limits).To(HaveKeyWithValue(corev1.ResourceName("hugepages-1Gi"), resource.MustParse("2Gi")))
+			Expect(mutated.Spec.Containers[0].VolumeMounts).To(ConsistOf(
+				pod.Spec.Containers[0].VolumeMounts[0],
+				WithTransform(func(mount corev1.VolumeMount) string { return mount.Name }, Equal(types.DefaultDownwardAPIVolumeName)),
+			))
+			Expect(mutated.Spec.Volumes).NotTo(ContainElement(WithTransform(func(volume corev1.Volume) string {
+				return volume.Name
+			}, Equal("hugepages-1gi"))))
+		})
+	})
+
+	Context("Tolerations", func() {
+		sriov := corev1.Toleration{Key: "example.com/sriov", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}
+		dpdk := corev1.Toleration{Key: "example.com/dpdk", Value: "true", Effect: corev1.TaintEffectNoSchedule}
+
+		BeforeEach(func() {
+			getter.nads["default/net-sriov"] = newNetAttachDef("default", "net-sriov", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a",
+				"k8s.v1.cni.cncf.io/tolerations":  `[{"key": "example.com/sriov", "operator": "Exists", "effect": "NoSchedule"}]`,
+			})
+			getter.nads["default/net-dpdk"] = newNetAttachDef("default", "net-dpdk", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-b",
+				"k8s.v1.cni.cncf.io/tolerations": `[{"key": "example.com/sriov", "operator": "Exists", "effect": "NoSchedule"},
+					{"key": "example.com/dpdk", "value": "true", "effect": "NoSchedule"}]`,
+			})
+		})
+
+		It("should add the tolerations of all networks once", func() {
+			pod := newPodWithNetworks("net-sriov, net-dpdk, net-sriov")
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(mutated.Spec.Tolerations).To(Equal([]corev1.Toleration{sriov, dpdk}))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.Tolerations).To(Equal([]corev1.Toleration{sriov, dpdk}))
+
+			resp := sendAdmissionReview(wh, mutated)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patch).To(BeEmpty())
+		})
+
+		It("should keep the tolerations of the pod", func() {
+			pod := newPodWithNetworks("net-dpdk")
+			owned := corev1.Toleration{Key: "example.com/dpdk", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule}
+			pod.Spec.Tolerations = []corev1.Toleration{owned}
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(mutated.Spec.Tolerations).To(Equal([]corev1.Toleration{owned, sriov}))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.Tolerations).To(Equal([]corev1.Toleration{sriov}))
+		})
+
+		It("should remove the recorded tolerations if the networks changed", func() {
+			pod := newPodWithNetworks("net-dpdk")
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			mutated.Annotations[networksAnnotationKey] = "net-sriov"
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.Tolerations).To(Equal([]corev1.Toleration{sriov}))
+		})
+
+		It("should reject networks with invalid tolerations", func() {
+			getter.nads["default/net-sriov"].Annotations["k8s.v1.cni.cncf.io/tolerations"] = `[{"operator": "Equal"}]`
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-sriov"))
+			Expect(resp.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("Hugepages Downward API", func() {
+		BeforeEach(func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.InjectHugepageDownAPI = true
+			})
+		})
+
+		downwardAPIItems := func(pod *corev1.Pod) map[string]string {
+			items := make(map[string]string)
+			for _, volume := range pod.Spec.Volumes {
+				if volume.Name == types.DefaultDownwardAPIVolumeName {
+					for _, item := range volume.DownwardAPI.Items {
+						if item.ResourceFieldRef != nil {
+							items[item.Path] = item.ResourceFieldRef.ContainerName + "/" + item.ResourceFieldRef.Resource
+						}
+					}
+				}
+			}
+			return items
+		}
+
+		It("should expose hugepages of any size of containers and init containers", func() {
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"hugepages-32Mi": resource.MustParse("64Mi")},
+				Limits:   corev1.ResourceList{"hugepages-32Mi": resource.MustParse("64Mi")},
+			}
+			pod.Spec.InitContainers = []corev1.Container{{
+				Name:  "init",
+				Image: "init",
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{"hugepages-16Gi": resource.MustParse("16Gi")},
+				},
+			}}
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+
+			Expect(downwardAPIItems(mutated)).To(Equal(map[string]string{
+				"hugepages_16G_limit_init":   "init/limits.hugepages-16Gi",
+				"hugepages_32M_request_test": "test/requests.hugepages-32Mi",
+				"hugepages_32M_limit_test":   "test/limits.hugepages-32Mi",
+			}))
+			Expect(mutated.Spec.InitContainers[0].Env).To(ContainElement(corev1.EnvVar{Name: "CONTAINER_NAME", Value: "init"}))
+			Expect(mutated.Spec.InitContainers[0].VolumeMounts).To(ConsistOf(corev1.VolumeMount{
+				Name:      types.DefaultDownwardAPIVolumeName,
+				ReadOnly:  true,
+				MountPath: types.DownwardAPIMountPath,
+			}))
+		})
+
+		It("should not mount the volume into init containers without hugepages", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DownwardAPIVolume.Containers = types.DownwardAPIContainersResources
+			})
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "init"}}
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(mutated.Spec.InitContainers[0].VolumeMounts).To(BeEmpty())
+		})
+
+		It("should keep the file names of 1Gi and 2Mi hugepages", func() {
+			Expect(hugepagePathPrefix("hugepages-1Gi") + "_request").To(Equal(types.Hugepages1GRequestPath))
+			Expect(hugepagePathPrefix("hugepages-1Gi") + "_limit").To(Equal(types.Hugepages1GLimitPath))
+			Expect(hugepagePathPrefix("hugepages-2Mi") + "_request").To(Equal(types.Hugepages2MRequestPath))
+			Expect(hugepagePathPrefix("hugepages-2Mi") + "_limit").To(Equal(types.Hugepages2MLimitPath))
+		})
+	})
+
+	Context("Downward API volume", func() {
+		newPodWithContainers := func() *corev1.Pod {
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "init"}}
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "sidecar"})
+			return pod
+		}
+
+		mountedBy := func(pod *corev1.Pod, name string) []string {
+			var containers []string
+			for _, list := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+				for _, container := range list {
+					for _, mount := range container.VolumeMounts {
+						if mount.Name == name {
+							containers = append(containers, container.Name)
+						}
+					}
+				}
+			}
+			return containers
+		}
+
+		It("should mount the volume into all containers by default", func() {
+			mutated := applyPatch(newPodWithContainers(), sendAdmissionReview(wh, newPodWithContainers()))
+			Expect(mountedBy(mutated, types.DefaultDownwardAPIVolumeName)).To(Equal([]string{"init", "test", "sidecar"}))
+		})
+
+		It("should use the configured name, mount path and read-only flag", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				readOnly := false
+				config.DownwardAPIVolume.Name = "netinfo"
+				config.DownwardAPIVolume.MountPath = "/var/run/netinfo"
+				config.DownwardAPIVolume.ReadOnly = &readOnly
+			})
+			mutated := applyPatch(newPodWithNetworks("net-a"), sendAdmissionReview(wh, newPodWithNetworks("net-a")))
+			Expect(mutated.Spec.Volumes).To(HaveLen(1))
+			Expect(mutated.Spec.Volumes[0].Name).To(Equal("netinfo"))
+			Expect(mutated.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{
+				{Name: "netinfo", MountPath: "/var/run/netinfo"},
+			}))
+		})
+
+		It("should only mount the volume into the containers receiving resources", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DownwardAPIVolume.Containers = types.DownwardAPIContainersResources
+			})
+			mutated := applyPatch(newPodWithContainers(), sendAdmissionReview(wh, newPodWithContainers()))
+			Expect(mountedBy(mutated, types.DefaultDownwardAPIVolumeName)).To(Equal([]string{"test"}))
+		})
+
+		It("should mount the volume into the annotated containers", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DownwardAPIVolume.Containers = types.DownwardAPIContainersAnnotated
+			})
+			pod := newPodWithContainers()
+			pod.Annotations[types.DownwardAPIContainersAnnotation] = "init, sidecar"
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(mountedBy(mutated, types.DefaultDownwardAPIVolumeName)).To(Equal([]string{"init", "sidecar"}))
+		})
+
+		It("should move the volume when its name is changed", func() {
+			mutated := applyPatch(newPodWithContainers(), sendAdmissionReview(wh, newPodWithContainers()))
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DownwardAPIVolume.Name = "netinfo"
+			})
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(mutated.Spec.Volumes).To(HaveLen(1))
+			Expect(mutated.Spec.Volumes[0].Name).To(Equal("netinfo"))
+			Expect(mountedBy(mutated, types.DefaultDownwardAPIVolumeName)).To(BeEmpty())
+			Expect(mountedBy(mutated, "netinfo")).To(Equal([]string{"init", "test", "sidecar"}))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.DownwardAPIVolume).To(Equal("netinfo"))
+		})
+
+		It("should project the configured annotations into files of their own", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DownwardAPIVolume.Annotations = []string{networksAnnotationKey, "k8s.v1.cni.cncf.io/network-status"}
+			})
+			mutated := applyPatch(newPodWithNetworks("net-a"), sendAdmissionReview(wh, newPodWithNetworks("net-a")))
+			Expect(mutated.Spec.Volumes).To(HaveLen(1))
+			Expect(mutated.Spec.Volumes[0].DownwardAPI.Items).To(Equal([]corev1.DownwardAPIVolumeFile{
+				{Path: types.AnnotationsPath, FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+				{Path: "networks", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['k8s.v1.cni.cncf.io/networks']"}},
+				{Path: "network-status", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['k8s.v1.cni.cncf.io/network-status']"}},
+			}))
+		})
+
+		It("should not mount the volume over another volume", func() {
+			pod := newPodWithContainers()
+			pod.Spec.Volumes = []corev1.Volume{{Name: "config"}}
+			pod.Spec.Containers[1].VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: types.DownwardAPIMountPath}}
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("container 'sidecar' already mounts volume 'config'"))
+			mutated := applyPatch(pod, resp)
+			Expect(mountedBy(mutated, types.DefaultDownwardAPIVolumeName)).To(Equal([]string{"init", "test"}))
+		})
+	})
+
+	Context("Device info", func() {
+		BeforeEach(func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DeviceInfo.Enabled = true
+			})
+		})
+
+		deviceInfoVolume := func(pod *corev1.Pod) *corev1.Volume {
+			for i := range pod.Spec.Volumes {
+				if pod.Spec.Volumes[i].HostPath != nil {
+					return &pod.Spec.Volumes[i]
+				}
+			}
+			return nil
+		}
+
+		It("should not mount the directory unless enabled", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DeviceInfo.Enabled = false
+			})
+			mutated := applyPatch(newPodWithNetworks("net-a"), sendAdmissionReview(wh, newPodWithNetworks("net-a")))
+			Expect(deviceInfoVolume(mutated)).To(BeNil())
+		})
+
+		It("should mount the directory read-only into the container receiving the resources", func() {
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "sidecar"})
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+
+			volume := deviceInfoVolume(mutated)
+			Expect(volume).NotTo(BeNil())
+			Expect(volume.Name).To(Equal("devinfo"))
+			Expect(volume.HostPath.Path).To(Equal(types.DefaultDeviceInfoPath))
+			Expect(*volume.HostPath.Type).To(Equal(corev1.HostPathDirectoryOrCreate))
+			Expect(mutated.Spec.Containers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{
+				Name:      "devinfo",
+				ReadOnly:  true,
+				MountPath: types.DefaultDeviceInfoPath,
+			}))
+			Expect(mutated.Spec.Containers[0].Env).To(BeEmpty())
+			Expect(mutated.Spec.Containers[1].VolumeMounts).NotTo(ContainElement(WithTransform(
+				func(mount corev1.VolumeMount) string { return mount.Name }, Equal("devinfo"))))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.DeviceInfoVolume).To(Equal("devinfo"))
+
+			resp := sendAdmissionReview(wh, mutated)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patch).To(BeEmpty())
+		})
+
+		It("should not mount the directory into pods without network resources", func() {
+			pod := newPodWithNetworks("net-a")
+			pod.Annotations = nil
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patch).To(BeEmpty())
+		})
+
+		It("should remove the directory when device info is disabled", func() {
+			mutated := applyPatch(newPodWithNetworks("net-a"), sendAdmissionReview(wh, newPodWithNetworks("net-a")))
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DeviceInfo.Enabled = false
+			})
+			mutated = applyPatch(mutated, sendAdmissionReview(wh, mutated))
+			Expect(deviceInfoVolume(mutated)).To(BeNil())
+			for _, mount := range mutated.Spec.Containers[0].VolumeMounts {
+				Expect(mount.Name).NotTo(Equal("devinfo"))
+			}
+		})
+
+		It("should keep a device-info directory mounted by the user", func() {
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.Volumes = []corev1.Volume{{Name: "devinfo", VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/var/run/k8s.cni.cncf.io/devinfo/dp"},
+			}}}
+			pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "devinfo", MountPath: types.DefaultDeviceInfoPath}}
+			resp := sendAdmissionReview(wh, pod)
+			Expect(resp.AuditAnnotations[warningsAuditAnnotationKey]).To(ContainSubstring("the device-info directory is not mounted"))
+			mutated := applyPatch(pod, resp)
+			Expect(mutated.Spec.Volumes).To(ContainElement(pod.Spec.Volumes[0]))
+			Expect(mutated.Spec.Containers[0].VolumeMounts).To(ContainElement(pod.Spec.Containers[0].VolumeMounts[0]))
+			record, err := getInjectionRecord(mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.DeviceInfoVolume).To(BeEmpty())
+		})
+
+		It("should not mount the directory into pods without containers", func() {
+			pc := &PodContext{
+				Pod:              &corev1.Pod{},
+				Config:           wh.Configuration(),
+				ResourceRequests: map[string]int64{"example.com/nic-a": 1},
+				record:           &types.InjectionRecord{},
+			}
+			warnings, err := mutateDeviceInfo(context.TODO(), pc)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
+			Expect(pc.Pod.Spec.Volumes).To(BeEmpty())
+		})
+
+		It("should rename the volume if the pod has another volume named devinfo", func() {
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.Volumes = []corev1.Volume{{Name: "devinfo"}}
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			Expect(deviceInfoVolume(mutated).Name).To(Equal("devinfo-1"))
+		})
+	})
+
+	Context("Resources Downward API", func() {
+		newPodWithResources := func() *corev1.Pod {
+			pod := newPodWithNetworks("net-a")
+			pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("2"), "memory": resource.MustParse("1Gi")},
+				Limits:   corev1.ResourceList{"cpu": resource.MustParse("2")},
+			}
+			pod.Spec.InitContainers = []corev1.Container{{
+				Name:  "init",
+				Image: "init",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{"ephemeral-storage": resource.MustParse("1Gi")},
+				},
+			}}
+			return pod
+		}
+
+		downwardAPIItems := func(pod *corev1.Pod) map[string]corev1.DownwardAPIVolumeFile {
+			items := make(map[string]corev1.DownwardAPIVolumeFile)
+			for _, volume := range pod.Spec.Volumes {
+				if volume.Name == types.DefaultDownwardAPIVolumeName {
+					for _, item := range volume.DownwardAPI.Items {
+						items[item.Path] = item
+					}
+				}
+			}
+			return items
+		}
+
+		It("should not expose resources by default", func() {
+			pod := newPodWithResources()
+			items := downwardAPIItems(applyPatch(pod, sendAdmissionReview(wh, pod)))
+			Expect(items).To(HaveLen(1))
+			Expect(items).To(HaveKey(types.AnnotationsPath))
+		})
+
+		It("should expose the configured requests and limits set in containers and init containers", func() {
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.DownwardAPIResources = []string{"cpu", "memory", "ephemeral-storage", "network-resources"}
+			})
+			pod := newPodWithResources()
+			mutated := applyPatch(pod, sendAdmissionReview(wh, pod))
+			items := downwardAPIItems(mutated)
+
+			Expect(items).To(HaveKey("cpu_request_test"))
+			Expect(items).To(HaveKey("memory_request_test"))
+			Expect(items).NotTo(HaveKey("memory_limit_test"))
+			Expect(items).To(HaveKey("ephemeral_storage_request_init"))
+			Expect(items["cpu_limit_test"].ResourceFieldRef).To(Equal(&corev1.ResourceFieldSelector{
+				ContainerName: "test",
+				Resource:      "limits.cpu",
+				Divisor:       resource.MustParse("1m"),
+			}))
+			Expect(items[types.NetworkResourcesPath].FieldRef.FieldPath).To(Equal(
+				"metadata.annotations['network-resources-injector.k8s.cni.cncf.io/injected']"))
+			Expect(mutated.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "CONTAINER_NAME", Value: "test"}))
+			Expect(mutated.Spec.InitContainers[0].VolumeMounts).To(HaveLen(1))
+		})
+	})
+
+	Context("API retries", func() {
+		unavailable := errors.NewServiceUnavailable("etcd leader changed")
+
+		newWebhookWithBackoff := func(backoff wait.Backoff, timeoutSeconds int32) *Webhook {
+			config := types.NewNRIConfiguration()
+			config.TimeoutSeconds = timeoutSeconds
+			wh, err := NewWebhook(Options{NetworkAttachmentDefinitions: getter, Config: config, Backoff: &backoff})
+			Expect(err).NotTo(HaveOccurred())
+			return wh
+		}
+
+		It("should retry transient errors", func() {
+			getter.errs["default/net-a"] = unavailable
+			getter.failures["default/net-a"] = 2
+			wh := newWebhookWithBackoff(wait.Backoff{Duration: time.Millisecond, Steps: 5}, types.DefaultTimeoutSeconds)
+
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(getter.calls).To(Equal(3))
+		})
+
+		It("should not retry permanent errors", func() {
+			wh := newWebhookWithBackoff(wait.Backoff{Duration: time.Millisecond, Steps: 5}, types.DefaultTimeoutSeconds)
+
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-unknown"))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(getter.calls).To(Equal(1))
+		})
+
+		It("should give up once the backoff steps are used up", func() {
+			getter.errs["default/net-a"] = unavailable
+			wh := newWebhookWithBackoff(wait.Backoff{Duration: time.Millisecond, Steps: 2}, types.DefaultTimeoutSeconds)
+
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("failed after 3 attempts"))
+			Expect(getter.calls).To(Equal(3))
+		})
+
+		It("should use nine tenths of the webhook timeout for API calls", func() {
+			config := types.NewNRIConfiguration()
+			Expect(requestTimeout(config)).To(Equal(9 * time.Second))
+			config.TimeoutSeconds = types.MaxTimeoutSeconds
+			Expect(requestTimeout(config)).To(Equal(27 * time.Second))
+		})
+
+		It("should stop retrying at the request deadline", func() {
+			getter.errs["default/net-a"] = unavailable
+			wh := newWebhookWithBackoff(wait.Backoff{Duration: 100 * time.Millisecond, Factor: 1, Steps: 100}, 1)
+
+			start := time.Now()
+			resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("network 'default/net-a' could not be resolved (Timeout)"))
+
+			wh.updateConfiguration(func(config *types.NRIConfiguration) {
+				config.FailurePolicy = types.FailurePolicyAllowUnmutated
+			})
+			resp = sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patch).To(BeEmpty())
+		})
+	})
+})
+
+var _ = DescribeTable("Classifying network errors",
+	func(err error, reason string) {
+		Expect(classifyNetworkError(err)).To(Equal(reason))
+	},
+	Entry("not found", errors.NewNotFound(schema.GroupResource{}, "net"), networkErrorNotFound),
+	Entry("forbidden", errors.NewForbidden(schema.GroupResource{}, "net", fmt.Errorf("denied")), networkErrorForbidden),
+	Entry("unauthorized", errors.NewUnauthorized("no token"), networkErrorForbidden),
+	Entry("server timeout", errors.NewServerTimeout(schema.GroupResource{}, "get", 1), networkErrorTimeout),
+	Entry("wrapped deadline", pkgerrors.Wrap(context.DeadlineExceeded, "get"), networkErrorTimeout),
+	Entry("other", fmt.Errorf("connection refused"), networkErrorUnknown),
+)
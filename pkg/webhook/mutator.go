@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gomodules.xyz/jsonpatch/v2"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+// PodContext holds the admitted pod together with everything resolved for it
+// before the mutators run
+type PodContext struct {
+	// Original is the admitted pod, it must not be modified
+	Original *corev1.Pod
+	// Pod is a copy of the admitted pod modified by the mutators
+	Pod *corev1.Pod
+	// Config is the configuration used for the whole request
+	Config *types.NRIConfiguration
+	// Networks holds what each network selection of the pod requires
+	Networks []*NetworkResources
+	// ResourceRequests maps the resources requested by the networks of the pod to their count
+	ResourceRequests map[string]int64
+	// NodeSelector holds the node labels required by the networks of the pod
+	NodeSelector map[string]string
+	// Overhead holds the cpu, memory and hugepages needed by the network attachments of the pod
+	Overhead corev1.ResourceList
+	// Hugepages holds the hugepages needed by the network attachments of the pod
+	Hugepages corev1.ResourceList
+	// Tolerations holds the tolerations required by the networks of the pod, each once
+	Tolerations []corev1.Toleration
+
+	/* record of the previous mutation of the pod, nil if there is none */
+	previousRecord *types.InjectionRecord
+	/* record of this mutation, stored in the pod once all mutators ran */
+	record *types.InjectionRecord
+	/* user-defined injections matching the pod labels */
+	userDefinedPatch []jsonPatchOperation
+	/* hugepage resources to expose via the Downward API volume */
+	hugepageResources []hugepageResourceData
+	/* other files to add to the Downward API volume */
+	downwardAPIFiles []corev1.DownwardAPIVolumeFile
+}
+
+// Mutator is a single step of the mutation pipeline. Mutate modifies PodContext.Pod
+// and returns warnings to report. An error denies the pod. The JSON patch sent to the
+// API server is computed from the differences between the original and modified pod,
+// so mutators only need to make sure the pod ends up in the desired state.
+type Mutator interface {
+	Name() string
+	Mutate(ctx context.Context, pc *PodContext) ([]string, error)
+}
+
+// MutateFunc is the signature of Mutator.Mutate
+type MutateFunc func(ctx context.Context, pc *PodContext) ([]string, error)
+
+type funcMutator struct {
+	name   string
+	mutate MutateFunc
+}
+
+// NewMutator creates a Mutator from a function
+func NewMutator(name string, mutate MutateFunc) Mutator {
+	return &funcMutator{name: name, mutate: mutate}
+}
+
+func (m *funcMutator) Name() string {
+	return m.name
+}
+
+func (m *funcMutator) Mutate(ctx context.Context, pc *PodContext) ([]string, error) {
+	return m.mutate(ctx, pc)
+}
+
+// MutatorRegistry holds mutators in the order they run
+type MutatorRegistry struct {
+	sync.RWMutex
+	mutators []Mutator
+}
+
+// NewMutatorRegistry creates an empty registry
+func NewMutatorRegistry() *MutatorRegistry {
+	return &MutatorRegistry{}
+}
+
+// Register appends a mutator to the pipeline. Names must be unique.
+func (r *MutatorRegistry) Register(m Mutator) error {
+	r.Lock()
+	defer r.Unlock()
+	if m.Name() == "" {
+		return errors.New("mutator name can not be empty")
+	}
+	for _, registered := range r.mutators {
+		if registered.Name() == m.Name() {
+			return fmt.Errorf("mutator '%s' is already registered", m.Name())
+		}
+	}
+	r.mutators = append(r.mutators, m)
+	return nil
+}
+
+// Names returns the names of the registered mutators in the order they run
+func (r *MutatorRegistry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+	names := make([]string, 0, len(r.mutators))
+	for _, m := range r.mutators {
+		names = append(names, m.Name())
+	}
+	return names
+}
+
+// validate checks that all names refer to registered mutators
+func (r *MutatorRegistry) validate(names []string) error {
+	registered := make(map[string]bool)
+	for _, name := range r.Names() {
+		registered[name] = true
+	}
+	for _, name := range names {
+		if !registered[name] {
+			return fmt.Errorf("unknown mutator '%s', registered mutators: %v", name, r.Names())
+		}
+	}
+	return nil
+}
+
+// enabled returns the mutators listed in names in registration order, or all of them if names is empty
+func (r *MutatorRegistry) enabled(names []string) []Mutator {
+	r.RLock()
+	defer r.RUnlock()
+	if len(names) == 0 {
+		return append([]Mutator(nil), r.mutators...)
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var mutators []Mutator
+	for _, m := range r.mutators {
+		if wanted[m.Name()] {
+			mutators = append(mutators, m)
+		}
+	}
+	return mutators
+}
+
+// DefaultMutatorRegistry holds the built-in mutators and is used by webhooks
+// created without a registry. Mutators registered later run after the built-ins.
+var DefaultMutatorRegistry = NewMutatorRegistry()
+
+// RegisterMutator appends a mutator to the default registry
+func RegisterMutator(m Mutator) error {
+	return DefaultMutatorRegistry.Register(m)
+}
+
+/* runMutators runs the enabled mutators on the pod copy and collects their warnings */
+func (wh *Webhook) runMutators(ctx context.Context, pc *PodContext) ([]string, error) {
+	var warnings []string
+	for _, m := range wh.mutators.enabled(pc.Config.Mutators) {
+		w, err := m.Mutate(ctx, pc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mutator '%s' failed", m.Name())
+		}
+		warnings = append(warnings, w...)
+	}
+	return warnings, nil
+}
+
+/* createPatch returns the JSON patch turning the original pod into the mutated one */
+func createPatch(original, mutated *corev1.Pod) ([]byte, error) {
+	originalBytes, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	mutatedBytes, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.CreatePatch(originalBytes, mutatedBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(patch)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+var _ = Describe("Mutators", func() {
+	var getter *fakeNetAttachDefGetter
+
+	BeforeEach(func() {
+		getter = newFakeNetAttachDefGetter(
+			newNetAttachDef("default", "net-a", map[string]string{
+				"k8s.v1.cni.cncf.io/resourceName": "example.com/nic-a",
+				nodeSelectorKey:                   "zone=a",
+			}),
+		)
+	})
+
+	/* newRegistry returns a registry with the built-in mutators followed by extra */
+	newRegistry := func(extra ...Mutator) *MutatorRegistry {
+		registry := NewMutatorRegistry()
+		for _, m := range DefaultMutatorRegistry.enabled(nil) {
+			Expect(registry.Register(m)).To(Succeed())
+		}
+		for _, m := range extra {
+			Expect(registry.Register(m)).To(Succeed())
+		}
+		return registry
+	}
+
+	It("should register the built-in mutators in order", func() {
+		Expect(DefaultMutatorRegistry.Names()).To(Equal([]string{
+			MutatorNetworkResources,
+			MutatorResourceOverhead,
+			MutatorNetworkHugepages,
+			MutatorHugepageDownwardAPI,
+			MutatorResourceDownwardAPI,
+			MutatorDownwardAPIVolume,
+			MutatorDeviceInfo,
+			MutatorUserDefinedInjections,
+			MutatorNodeSelector,
+			MutatorTolerations,
+		}))
+	})
+
+	It("should reject duplicate names", func() {
+		registry := NewMutatorRegistry()
+		noop := func(ctx context.Context, pc *PodContext) ([]string, error) {
+			return nil, nil
+		}
+		Expect(registry.Register(NewMutator("noop", noop))).To(Succeed())
+		Expect(registry.Register(NewMutator("noop", noop))).NotTo(Succeed())
+		Expect(registry.Register(NewMutator("", noop))).NotTo(Succeed())
+	})
+
+	It("should reject configurations enabling unknown mutators", func() {
+		config := types.NewNRIConfiguration()
+		config.Mutators = []string{"unknown"}
+		_, err := NewWebhook(Options{Config: config})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only run the enabled mutators", func() {
+		config := types.NewNRIConfiguration()
+		config.Mutators = []string{MutatorNodeSelector}
+		wh, err := NewWebhook(Options{NetworkAttachmentDefinitions: getter, Config: config})
+		Expect(err).NotTo(HaveOccurred())
+
+		resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+		Expect(resp.Allowed).To(BeTrue())
+		mutated := applyPatch(newPodWithNetworks("net-a"), resp)
+		Expect(mutated.Spec.NodeSelector).To(Equal(map[string]string{"zone": "a"}))
+		Expect(mutated.Spec.Containers[0].Resources).To(Equal(corev1.ResourceRequirements{}))
+		Expect(mutated.Spec.Volumes).To(BeEmpty())
+	})
+
+	It("should run registered mutators after the built-ins and report their warnings", func() {
+		var seen *PodContext
+		custom := NewMutator("custom", func(ctx context.Context, pc *PodContext) ([]string, error) {
+			seen = pc
+			pc.Pod.Labels = map[string]string{"custom": "true"}
+			return []string{"custom warning"}, nil
+		})
+		wh, err := NewWebhook(Options{NetworkAttachmentDefinitions: getter, Mutators: newRegistry(custom)})
+		Expect(err).NotTo(HaveOccurred())
+
+		resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(seen.ResourceRequests).To(Equal(map[string]int64{"example.com/nic-a": 1}))
+		Expect(seen.Pod.Spec.Containers[0].Resources.Requests).To(HaveKey(corev1.ResourceName("example.com/nic-a")))
+		Expect(decodePatch(resp)).To(ContainElement(jsonPatchOperation{
+			Operation: "add",
+			Path:      "/metadata/labels",
+			Value:     map[string]interface{}{"custom": "true"},
+		}))
+		Expect(resp.AuditAnnotations).To(HaveKeyWithValue(warningsAuditAnnotationKey, "custom warning"))
+	})
+
+	It("should deny the pod if a mutator fails", func() {
+		failing := NewMutator("failing", func(ctx context.Context, pc *PodContext) ([]string, error) {
+			return nil, errors.New("site policy violated")
+		})
+		wh, err := NewWebhook(Options{NetworkAttachmentDefinitions: getter, Mutators: newRegistry(failing)})
+		Expect(err).NotTo(HaveOccurred())
+
+		resp := sendAdmissionReview(wh, newPodWithNetworks("net-a"))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Message).To(ContainSubstring("site policy violated"))
+	})
+})
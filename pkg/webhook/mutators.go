@@ -0,0 +1,887 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+// Names of the built-in mutators, in the order they run
+const (
+	MutatorNetworkResources      = "network-resources"
+	MutatorResourceOverhead      = "resource-overhead"
+	MutatorNetworkHugepages      = "network-hugepages"
+	MutatorHugepageDownwardAPI   = "hugepage-downward-api"
+	MutatorResourceDownwardAPI   = "resource-downward-api"
+	MutatorDownwardAPIVolume     = "downward-api-volume"
+	MutatorDeviceInfo            = "device-info"
+	MutatorUserDefinedInjections = "user-defined-injections"
+	MutatorNodeSelector          = "node-selector"
+	MutatorTolerations           = "tolerations"
+)
+
+const deviceInfoVolumeName = "devinfo"
+
+func init() {
+	for _, m := range []Mutator{
+		NewMutator(MutatorNetworkResources, mutateNetworkResources),
+		NewMutator(MutatorResourceOverhead, mutateResourceOverhead),
+		NewMutator(MutatorNetworkHugepages, mutateNetworkHugepages),
+		NewMutator(MutatorHugepageDownwardAPI, mutateHugepageDownwardAPI),
+		NewMutator(MutatorResourceDownwardAPI, mutateResourceDownwardAPI),
+		NewMutator(MutatorDownwardAPIVolume, mutateDownwardAPIVolume),
+		NewMutator(MutatorDeviceInfo, mutateDeviceInfo),
+		NewMutator(MutatorUserDefinedInjections, mutateUserDefinedInjections),
+		NewMutator(MutatorNodeSelector, mutateNodeSelector),
+		NewMutator(MutatorTolerations, mutateTolerations),
+	} {
+		if err := RegisterMutator(m); err != nil {
+			panic(err)
+		}
+	}
+}
+
+/* setNetworkResources sets the requests and limits of a container, honor adds them to the existing amounts */
+func setNetworkResources(container *corev1.Container, resourceList corev1.ResourceList, honor bool) {
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+	for name, quantity := range resourceList {
+		reqQuantity := quantity.DeepCopy()
+		limitQuantity := quantity.DeepCopy()
+		if honor {
+			if value, ok := container.Resources.Requests[name]; ok {
+				reqQuantity.Add(value)
+			}
+			if value, ok := container.Resources.Limits[name]; ok {
+				limitQuantity.Add(value)
+			}
+		}
+		container.Resources.Requests[name] = reqQuantity
+		container.Resources.Limits[name] = limitQuantity
+	}
+}
+
+/* setEnv adds an environment variable to a container unless it is defined already */
+func setEnv(container *corev1.Container, name, value string) []string {
+	for _, env := range container.Env {
+		if env.Name == name {
+			if env.Value != value {
+				return []string{fmt.Sprintf("container '%s' defines env '%s' with value '%s' instead of '%s'",
+					container.Name, name, env.Value, value)}
+			}
+			return nil
+		}
+	}
+	container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: value})
+	return nil
+}
+
+/* setVolume adds a volume to the pod or replaces the volume with the same name */
+func setVolume(pod *corev1.Pod, volume corev1.Volume) {
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == volume.Name {
+			pod.Spec.Volumes[i] = volume
+			return
+		}
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+}
+
+/* removeVolume removes the volume with the given name from the pod */
+func removeVolume(pod *corev1.Pod, name string) {
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == name {
+			pod.Spec.Volumes = append(pod.Spec.Volumes[:i], pod.Spec.Volumes[i+1:]...)
+			return
+		}
+	}
+}
+
+/* removeVolumeMount removes the mount of the volume with the given name from a container */
+func removeVolumeMount(container *corev1.Container, name string) {
+	for i := range container.VolumeMounts {
+		if container.VolumeMounts[i].Name == name {
+			container.VolumeMounts = append(container.VolumeMounts[:i], container.VolumeMounts[i+1:]...)
+			return
+		}
+	}
+}
+
+/* setVolumeMount adds a volume mount to a container or replaces the mount of the same volume */
+func setVolumeMount(container *corev1.Container, mount corev1.VolumeMount) {
+	for i := range container.VolumeMounts {
+		if container.VolumeMounts[i].Name == mount.Name {
+			container.VolumeMounts[i] = mount
+			return
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, mount)
+}
+
+// mutateNetworkResources adds the network resources to the requests and limits of the first
+// container. Resources recorded by a previous mutation are removed first, so that mutating
+// the pod again, e.g. on reinvocation, does not add them twice.
+func mutateNetworkResources(ctx context.Context, pc *PodContext) ([]string, error) {
+	if len(pc.ResourceRequests) == 0 && len(pc.record.Resources) == 0 {
+		glog.Infof("pod doesn't need any custom network resources")
+		return nil, nil
+	}
+	glog.Infof("honor-resources=%v", pc.Config.HonorExistingResources)
+	container := &pc.Pod.Spec.Containers[0]
+	if pc.previousRecord != nil {
+		removeNetworkResources(container, pc.previousRecord.Resources, pc.Config.HonorExistingResources)
+	}
+	setNetworkResources(container, *getResourceList(pc.ResourceRequests), pc.Config.HonorExistingResources)
+
+	pc.record.Resources = make(map[string]int64)
+	for name, count := range pc.ResourceRequests {
+		pc.record.Resources[name] = count
+	}
+	pc.record.Networks = nil
+	for _, network := range pc.Networks {
+		pc.record.Networks = append(pc.record.Networks, networkInjections(network, container.Name)...)
+	}
+	return nil, nil
+}
+
+// mutateResourceOverhead adds the overhead of the network attachments to the requests of the
+// first container, and to its limits which are set. A request which is not set defaults to the
+// limit. Hugepages requests and limits must be equal, so hugepages are always added to both.
+// Requests and limits which are equal stay equal, so a Guaranteed container stays Guaranteed,
+// and Burstable and BestEffort containers get no new cpu or memory limits. Overhead recorded
+// by a previous mutation is removed first.
+func mutateResourceOverhead(ctx context.Context, pc *PodContext) ([]string, error) {
+	if len(pc.Pod.Spec.Containers) == 0 {
+		return nil, nil
+	}
+	container := &pc.Pod.Spec.Containers[0]
+	if pc.previousRecord != nil {
+		removeResourceOverhead(container, pc.previousRecord)
+	}
+	pc.record.OverheadRequests = nil
+	pc.record.OverheadLimits = nil
+	if len(pc.Overhead) == 0 {
+		return nil, nil
+	}
+	glog.Infof("network resource overhead %v of container '%s'", pc.Overhead, container.Name)
+
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+	pc.record.OverheadRequests = corev1.ResourceList{}
+	pc.record.OverheadLimits = corev1.ResourceList{}
+	for name, overhead := range pc.Overhead {
+		oldLimit, hasLimit := container.Resources.Limits[name]
+		request := overhead.DeepCopy()
+		if value, ok := container.Resources.Requests[name]; ok {
+			request.Add(value)
+		} else if hasLimit {
+			request.Add(oldLimit)
+		}
+		container.Resources.Requests[name] = request
+		pc.record.OverheadRequests[name] = overhead.DeepCopy()
+
+		isHugepages := strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix)
+		if !hasLimit && !isHugepages {
+			continue
+		}
+		limit := overhead.DeepCopy()
+		limit.Add(oldLimit)
+		if isHugepages {
+			limit = request.DeepCopy()
+		}
+		container.Resources.Limits[name] = limit
+		addedLimit := limit.DeepCopy()
+		addedLimit.Sub(oldLimit)
+		pc.record.OverheadLimits[name] = addedLimit
+	}
+	if len(container.Resources.Limits) == 0 {
+		container.Resources.Limits = nil
+	}
+	if len(pc.record.OverheadLimits) == 0 {
+		pc.record.OverheadLimits = nil
+	}
+	return nil, nil
+}
+
+/* networkInjections describes the resources of a network injected into a container, ordered by resource name */
+func networkInjections(network *NetworkResources, containerName string) []types.NetworkInjection {
+	var names []string
+	for name := range network.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var injections []types.NetworkInjection
+	for _, name := range names {
+		injections = append(injections, types.NetworkInjection{
+			Network:   network.Selection.Namespace + "/" + network.Selection.Name,
+			Interface: network.Selection.InterfaceRequest,
+			Resource:  name,
+			Count:     network.Resources[name],
+			Container: containerName,
+		})
+	}
+	return injections
+}
+
+/* appendHugepageResource records a hugepage resource of a container if it is set in resources and not recorded yet */
+func appendHugepageResource(hugepageResourceList []hugepageResourceData, resources corev1.ResourceList,
+	name corev1.ResourceName, fieldPrefix, path string, container *corev1.Container) ([]hugepageResourceData, bool) {
+	if quantity, exists := resources[name]; exists && quantity.IsZero() == false {
+		data := hugepageResourceData{
+			ResourceName:  fieldPrefix + string(name),
+			ContainerName: container.Name,
+			Path:          path + "_" + container.Name,
+		}
+		for _, recorded := range hugepageResourceList {
+			if recorded == data {
+				return hugepageResourceList, true
+			}
+		}
+		return append(hugepageResourceList, data), true
+	}
+	return hugepageResourceList, false
+}
+
+/* hugepageVolumeName returns the name of the volume holding hugepages of a size, e.g. hugepages-1gi */
+func hugepageVolumeName(name corev1.ResourceName) string {
+	return strings.ToLower(string(name))
+}
+
+// hugepagePathPrefix returns the prefix of the Downward API files of a hugepage resource, derived
+// from its size without the trailing i, e.g. hugepages_1G for hugepages-1Gi or hugepages_32M for
+// hugepages-32Mi.
+func hugepagePathPrefix(name corev1.ResourceName) string {
+	size := strings.TrimPrefix(string(name), corev1.ResourceHugePagesPrefix)
+	return "hugepages_" + strings.TrimSuffix(size, "i")
+}
+
+// mutateNetworkHugepages adds the hugepages required by the networks to the requests and limits
+// of the first container. Pages of each size are mounted from an emptyDir volume and exposed
+// via the Downward API. Volumes of the user are kept: the hugepages volume gets a free name if
+// the pod has a volume of the same name, and is not mounted if the container already mounts
+// another volume at its path. Hugepages and volumes recorded by a previous mutation are
+// removed first.
+func mutateNetworkHugepages(ctx context.Context, pc *PodContext) ([]string, error) {
+	container := &pc.Pod.Spec.Containers[0]
+	/* recorded volumes still needed are updated in place, the others removed at the end */
+	previousVolumes := make(map[string]string)
+	if pc.previousRecord != nil {
+		for name, quantity := range pc.previousRecord.Hugepages {
+			subtractQuantity(container.Resources.Requests, name, quantity)
+			subtractQuantity(container.Resources.Limits, name, quantity)
+			if volume := recordedHugepageVolume(pc.Pod, pc.previousRecord, name); volume != "" {
+				previousVolumes[string(name)] = volume
+			}
+		}
+	}
+	pc.record.Hugepages = nil
+	pc.record.HugepageVolumes = nil
+	if len(pc.Hugepages) == 0 {
+		removeUnusedVolumes(pc.Pod, previousVolumes, nil)
+		return nil, nil
+	}
+	glog.Infof("network hugepages %v", pc.Hugepages)
+
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+	var names []string
+	for name := range pc.Hugepages {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	var warnings []string
+	volumes := make(map[string]string)
+	for _, n := range names {
+		name := corev1.ResourceName(n)
+		amount := pc.Hugepages[name]
+		for _, resources := range []corev1.ResourceList{container.Resources.Requests, container.Resources.Limits} {
+			quantity := amount.DeepCopy()
+			if value, ok := resources[name]; ok {
+				quantity.Add(value)
+			}
+			resources[name] = quantity
+		}
+
+		pathPrefix := hugepagePathPrefix(name)
+		pc.hugepageResources, _ = appendHugepageResource(pc.hugepageResources, container.Resources.Requests,
+			name, "requests.", pathPrefix+"_request", container)
+		pc.hugepageResources, _ = appendHugepageResource(pc.hugepageResources, container.Resources.Limits,
+			name, "limits.", pathPrefix+"_limit", container)
+
+		size := strings.TrimPrefix(n, corev1.ResourceHugePagesPrefix)
+		mountPath := pc.Config.HugepagesMountPath + "-" + size
+		previous := previousVolumes[n]
+		if other := mountAtPath(container, mountPath, previous); other != "" {
+			warnings = append(warnings, fmt.Sprintf("container '%s' already mounts volume '%s' at %s, the %s hugepages are not mounted",
+				container.Name, other, mountPath, size))
+			continue
+		}
+		volume := hugepageVolumeName(name)
+		if previous != "" {
+			volume = previous
+		} else if hasVolume(pc.Pod, volume) {
+			volume = freeVolumeName(pc.Pod, volume, "")
+			warnings = append(warnings, fmt.Sprintf("pod already has a volume named '%s', the %s hugepages volume is named '%s'",
+				hugepageVolumeName(name), size, volume))
+		}
+		setVolume(pc.Pod, corev1.Volume{
+			Name: volume,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMedium("HugePages-" + size)},
+			},
+		})
+		setVolumeMount(container, corev1.VolumeMount{Name: volume, MountPath: mountPath})
+		volumes[n] = volume
+	}
+	removeUnusedVolumes(pc.Pod, previousVolumes, volumes)
+	pc.record.Hugepages = pc.Hugepages.DeepCopy()
+	if len(volumes) > 0 {
+		pc.record.HugepageVolumes = volumes
+	}
+	return append(warnings, setEnv(container, types.EnvNameContainerName, container.Name)...), nil
+}
+
+/* removeUnusedVolumes removes the previous volumes, keyed by resource, which are not used anymore */
+func removeUnusedVolumes(pod *corev1.Pod, previous, current map[string]string) {
+	for name, volume := range previous {
+		if current[name] != volume {
+			removeVolumeWithMounts(pod, volume)
+		}
+	}
+}
+
+/* recordedHugepageVolume returns the volume added for hugepages by a previous mutation, if any */
+func recordedHugepageVolume(pod *corev1.Pod, record *types.InjectionRecord, name corev1.ResourceName) string {
+	if record.HugepageVolumes != nil {
+		return record.HugepageVolumes[string(name)]
+	}
+	/* records written before the volumes were recorded used the default name */
+	size := strings.TrimPrefix(string(name), corev1.ResourceHugePagesPrefix)
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == hugepageVolumeName(name) && volume.EmptyDir != nil &&
+			volume.EmptyDir.Medium == corev1.StorageMedium("HugePages-"+size) {
+			return volume.Name
+		}
+	}
+	return ""
+}
+
+/* sortedHugepageNames returns the hugepage resources of a resource list in name order */
+func sortedHugepageNames(resources corev1.ResourceList) []corev1.ResourceName {
+	var names []string
+	for name := range resources {
+		if strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix) {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	hugepageNames := make([]corev1.ResourceName, 0, len(names))
+	for _, name := range names {
+		hugepageNames = append(hugepageNames, corev1.ResourceName(name))
+	}
+	return hugepageNames
+}
+
+/* appendContainerHugepages records the hugepage requests and limits of any size set in a container */
+func appendContainerHugepages(hugepageResourceList []hugepageResourceData, container *corev1.Container) ([]hugepageResourceData, bool) {
+	var found bool
+	for _, name := range sortedHugepageNames(container.Resources.Requests) {
+		var ok bool
+		hugepageResourceList, ok = appendHugepageResource(hugepageResourceList, container.Resources.Requests,
+			name, "requests.", hugepagePathPrefix(name)+"_request", container)
+		found = found || ok
+	}
+	for _, name := range sortedHugepageNames(container.Resources.Limits) {
+		var ok bool
+		hugepageResourceList, ok = appendHugepageResource(hugepageResourceList, container.Resources.Limits,
+			name, "limits.", hugepagePathPrefix(name)+"_limit", container)
+		found = found || ok
+	}
+	return hugepageResourceList, found
+}
+
+// mutateHugepageDownwardAPI determines if hugepages of any size are being requested for a given
+// container or init container, and if so, exposes the value to the container via Downward API.
+func mutateHugepageDownwardAPI(ctx context.Context, pc *PodContext) ([]string, error) {
+	glog.Infof("injectHugepageDownApi=%v", pc.Config.InjectHugepageDownAPI)
+	if len(pc.ResourceRequests) == 0 || !pc.Config.InjectHugepageDownAPI {
+		return nil, nil
+	}
+	var warnings []string
+	for _, containers := range [][]corev1.Container{pc.Pod.Spec.InitContainers, pc.Pod.Spec.Containers} {
+		for i := range containers {
+			container := &containers[i]
+			var found bool
+			pc.hugepageResources, found = appendContainerHugepages(pc.hugepageResources, container)
+
+			// If Hugepages are being added to Downward API, add the
+			// 'container.Name' as an environment variable to the container
+			// so container knows its name and can process hugepages properly.
+			if found {
+				warnings = append(warnings, setEnv(container, types.EnvNameContainerName, container.Name)...)
+			}
+		}
+	}
+	return warnings, nil
+}
+
+/* downwardAPIDivisors are the units of the resources exposed by mutateResourceDownwardAPI */
+var downwardAPIDivisors = map[string]resource.Quantity{
+	types.DownwardAPIResourceCPU:              resource.MustParse("1m"),
+	types.DownwardAPIResourceMemory:           resource.MustParse("1Mi"),
+	types.DownwardAPIResourceEphemeralStorage: resource.MustParse("1Mi"),
+}
+
+// mutateResourceDownwardAPI exposes the configured requests and limits set in the containers and
+// init containers, and the injected network resources, in the Downward API volume.
+func mutateResourceDownwardAPI(ctx context.Context, pc *PodContext) ([]string, error) {
+	if len(pc.Config.DownwardAPIResources) == 0 || (len(pc.ResourceRequests) == 0 && len(pc.hugepageResources) == 0) {
+		return nil, nil
+	}
+	for _, name := range pc.Config.DownwardAPIResources {
+		if name == types.DownwardAPIResourceNetwork {
+			pc.downwardAPIFiles = append(pc.downwardAPIFiles, corev1.DownwardAPIVolumeFile{
+				Path: types.NetworkResourcesPath,
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: fmt.Sprintf("metadata.annotations['%s']", types.InjectionRecordAnnotation),
+				},
+			})
+		}
+	}
+
+	var warnings []string
+	for _, containers := range [][]corev1.Container{pc.Pod.Spec.InitContainers, pc.Pod.Spec.Containers} {
+		for i := range containers {
+			container := &containers[i]
+			var found bool
+			for _, name := range pc.Config.DownwardAPIResources {
+				divisor, ok := downwardAPIDivisors[name]
+				if !ok {
+					continue
+				}
+				filePrefix := strings.Replace(name, "-", "_", -1)
+				for _, field := range []struct {
+					resources corev1.ResourceList
+					prefix    string
+					suffix    string
+				}{
+					{container.Resources.Requests, "requests.", types.RequestPathSuffix},
+					{container.Resources.Limits, "limits.", types.LimitPathSuffix},
+				} {
+					if quantity, exists := field.resources[corev1.ResourceName(name)]; !exists || quantity.IsZero() {
+						continue
+					}
+					pc.downwardAPIFiles = append(pc.downwardAPIFiles, corev1.DownwardAPIVolumeFile{
+						Path: filePrefix + field.suffix + "_" + container.Name,
+						ResourceFieldRef: &corev1.ResourceFieldSelector{
+							Resource:      field.prefix + name,
+							ContainerName: container.Name,
+							Divisor:       divisor.DeepCopy(),
+						},
+					})
+					found = true
+				}
+			}
+			if found {
+				warnings = append(warnings, setEnv(container, types.EnvNameContainerName, container.Name)...)
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// mutateDownwardAPIVolume exposes the pod labels, annotations and resource files in a Downward
+// API volume, mounted into the containers selected by the configuration. The volume recorded
+// by a previous mutation is replaced. A volume of the same name defined by the user is kept,
+// the Downward API volume then gets a free name.
+func mutateDownwardAPIVolume(ctx context.Context, pc *PodContext) ([]string, error) {
+	previous := ""
+	if pc.previousRecord != nil {
+		previous = pc.previousRecord.DownwardAPIVolume
+	}
+	pc.record.DownwardAPIVolume = ""
+	if len(pc.ResourceRequests) == 0 && len(pc.hugepageResources) == 0 {
+		if previous != "" {
+			removeVolumeWithMounts(pc.Pod, previous)
+		}
+		return nil, nil
+	}
+
+	dAPIItems := []corev1.DownwardAPIVolumeFile{}
+	if len(pc.Pod.Labels) > 0 {
+		dAPIItems = append(dAPIItems, corev1.DownwardAPIVolumeFile{
+			Path:     types.LabelsPath,
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"},
+		})
+	}
+	if len(pc.Pod.Annotations) > 0 {
+		dAPIItems = append(dAPIItems, corev1.DownwardAPIVolumeFile{
+			Path:     types.AnnotationsPath,
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"},
+		})
+	}
+	/* the files are projected even if the annotation is not set yet, e.g. network-status */
+	for _, key := range pc.Config.DownwardAPIVolume.Annotations {
+		dAPIItems = append(dAPIItems, corev1.DownwardAPIVolumeFile{
+			Path:     types.AnnotationPath(key),
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", key)},
+		})
+	}
+	for _, hugepageResource := range pc.hugepageResources {
+		dAPIItems = append(dAPIItems, corev1.DownwardAPIVolumeFile{
+			Path: hugepageResource.Path,
+			ResourceFieldRef: &corev1.ResourceFieldSelector{
+				Resource:      hugepageResource.ResourceName,
+				ContainerName: hugepageResource.ContainerName,
+				Divisor:       *resource.NewQuantity(1*1024*1024, resource.BinarySI),
+			},
+		})
+	}
+	dAPIItems = append(dAPIItems, pc.downwardAPIFiles...)
+
+	var warnings []string
+	config := pc.Config.DownwardAPIVolume
+	name := config.Name
+	if !ownsDownwardAPIVolume(pc, name) {
+		name = freeVolumeName(pc.Pod, name, previous)
+		warnings = append(warnings, fmt.Sprintf("pod already has a volume named '%s', the Downward API volume is named '%s'",
+			config.Name, name))
+	}
+	if previous != "" && previous != name {
+		removeVolumeWithMounts(pc.Pod, previous)
+	}
+
+	setVolume(pc.Pod, corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{Items: dAPIItems},
+		},
+	})
+	mount := corev1.VolumeMount{
+		Name:      name,
+		ReadOnly:  config.ReadOnly == nil || *config.ReadOnly,
+		MountPath: config.MountPath,
+	}
+	selected := downwardAPIContainers(pc, dAPIItems)
+	for _, containers := range [][]corev1.Container{pc.Pod.Spec.InitContainers, pc.Pod.Spec.Containers} {
+		for i := range containers {
+			container := &containers[i]
+			if !selected[container.Name] {
+				removeVolumeMount(container, name)
+				continue
+			}
+			if other := mountAtPath(container, config.MountPath, name); other != "" {
+				removeVolumeMount(container, name)
+				warnings = append(warnings, fmt.Sprintf("container '%s' already mounts volume '%s' at %s, the Downward API volume is not mounted",
+					container.Name, other, config.MountPath))
+				continue
+			}
+			setVolumeMount(container, mount)
+		}
+	}
+	pc.record.DownwardAPIVolume = name
+	return warnings, nil
+}
+
+/* ownsDownwardAPIVolume tells if the volume with the given name is free or was added by the injector */
+func ownsDownwardAPIVolume(pc *PodContext, name string) bool {
+	for _, volume := range pc.Pod.Spec.Volumes {
+		if volume.Name != name {
+			continue
+		}
+		if pc.previousRecord == nil {
+			return false
+		}
+		/* records written before the volume name was recorded only tell that the pod was mutated */
+		return pc.previousRecord.DownwardAPIVolume == name ||
+			(pc.previousRecord.DownwardAPIVolume == "" && volume.DownwardAPI != nil)
+	}
+	return true
+}
+
+/* freeVolumeName returns the first of name-1, name-2... which is not a volume of the pod, or is the recorded volume */
+func freeVolumeName(pod *corev1.Pod, name, recorded string) string {
+	used := make(map[string]bool)
+	for _, volume := range pod.Spec.Volumes {
+		used[volume.Name] = volume.Name != recorded
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if !used[candidate] {
+			return candidate
+		}
+	}
+}
+
+/* removeVolumeWithMounts removes the volume with the given name and its mounts from the pod */
+func removeVolumeWithMounts(pod *corev1.Pod, name string) {
+	removeVolume(pod, name)
+	for i := range pod.Spec.InitContainers {
+		removeVolumeMount(&pod.Spec.InitContainers[i], name)
+	}
+	for i := range pod.Spec.Containers {
+		removeVolumeMount(&pod.Spec.Containers[i], name)
+	}
+}
+
+/* mountAtPath returns the name of another volume mounted by the container at path, if any */
+func mountAtPath(container *corev1.Container, path, name string) string {
+	for _, mount := range container.VolumeMounts {
+		if mount.MountPath == path && mount.Name != name {
+			return mount.Name
+		}
+	}
+	return ""
+}
+
+/* downwardAPIContainers returns the names of the containers which mount the Downward API volume */
+func downwardAPIContainers(pc *PodContext, items []corev1.DownwardAPIVolumeFile) map[string]bool {
+	selected := make(map[string]bool)
+	switch pc.Config.DownwardAPIVolume.Containers {
+	case types.DownwardAPIContainersResources:
+		/* the first container receives the network resources */
+		selected[pc.Pod.Spec.Containers[0].Name] = true
+		for _, item := range items {
+			if item.ResourceFieldRef != nil {
+				selected[item.ResourceFieldRef.ContainerName] = true
+			}
+		}
+	case types.DownwardAPIContainersAnnotated:
+		for _, name := range strings.Split(pc.Pod.Annotations[types.DownwardAPIContainersAnnotation], ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				selected[name] = true
+			}
+		}
+	default:
+		for _, container := range pc.Pod.Spec.InitContainers {
+			selected[container.Name] = true
+		}
+		for _, container := range pc.Pod.Spec.Containers {
+			selected[container.Name] = true
+		}
+	}
+	return selected
+}
+
+// mutateDeviceInfo mounts the device-info directory of the nodes read-only into the first
+// container, which receives the network resources. Device plugins and CNIs write the device
+// files of the pods into its dp and cni directories, the file names tell which device and pod
+// they describe. The volume is a DirectoryOrCreate hostPath, so that pods also start on nodes
+// where no device-info file was written yet.
+func mutateDeviceInfo(ctx context.Context, pc *PodContext) ([]string, error) {
+	previous := ""
+	if pc.previousRecord != nil {
+		previous = pc.previousRecord.DeviceInfoVolume
+	}
+	pc.record.DeviceInfoVolume = ""
+	config := pc.Config.DeviceInfo
+	if !config.Enabled || len(pc.ResourceRequests) == 0 {
+		if previous != "" {
+			removeVolumeWithMounts(pc.Pod, previous)
+		}
+		return nil, nil
+	}
+	if len(pc.Pod.Spec.Containers) == 0 {
+		return nil, nil
+	}
+	container := &pc.Pod.Spec.Containers[0]
+
+	/* e.g. a hostPath of the device-info directory added by the user */
+	if other := mountAtPath(container, config.MountPath, previous); other != "" {
+		if previous != "" {
+			removeVolumeWithMounts(pc.Pod, previous)
+		}
+		return []string{fmt.Sprintf("container '%s' already mounts volume '%s' at %s, the device-info directory is not mounted",
+			container.Name, other, config.MountPath)}, nil
+	}
+
+	var warnings []string
+	name := deviceInfoVolumeName
+	if name != previous && hasVolume(pc.Pod, name) {
+		name = freeVolumeName(pc.Pod, name, previous)
+		warnings = append(warnings, fmt.Sprintf("pod already has a volume named '%s', the device-info volume is named '%s'",
+			deviceInfoVolumeName, name))
+	}
+	if previous != "" && previous != name {
+		removeVolumeWithMounts(pc.Pod, previous)
+	}
+
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	setVolume(pc.Pod, corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: config.HostPath, Type: &hostPathType},
+		},
+	})
+	setVolumeMount(container, corev1.VolumeMount{
+		Name:      name,
+		ReadOnly:  true,
+		MountPath: config.MountPath,
+	})
+	pc.record.DeviceInfoVolume = name
+	return warnings, nil
+}
+
+/* hasVolume tells if the pod has a volume with the given name */
+func hasVolume(pod *corev1.Pod, name string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+/* mutateUserDefinedInjections adds the annotations of the user-defined injections matching the pod labels */
+func mutateUserDefinedInjections(ctx context.Context, pc *PodContext) ([]string, error) {
+	if len(pc.ResourceRequests) == 0 {
+		return nil, nil
+	}
+	var warnings []string
+	for _, p := range pc.userDefinedPatch {
+		if p.Path != "/metadata/annotations" {
+			continue
+		}
+		values, ok := p.Value.(map[string]interface{})
+		if !ok {
+			warnings = append(warnings, "user-defined annotations are not a map")
+			continue
+		}
+		if pc.Pod.Annotations == nil {
+			pc.Pod.Annotations = make(map[string]string)
+		}
+		for k, v := range values {
+			value, ok := v.(string)
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("user-defined annotation '%s' is not a string", k))
+				continue
+			}
+			pc.Pod.Annotations[k] = value
+		}
+	}
+	return warnings, nil
+}
+
+// mutateNodeSelector adds the node labels required by the networks to the pod node selector.
+// Only the labels the pod did not have are recorded, and those added by a previous mutation
+// which are no longer required are removed.
+func mutateNodeSelector(ctx context.Context, pc *PodContext) ([]string, error) {
+	if pc.previousRecord != nil {
+		for _, key := range pc.previousRecord.NodeSelector {
+			if _, ok := pc.NodeSelector[key]; !ok {
+				delete(pc.Pod.Spec.NodeSelector, key)
+			}
+		}
+	}
+	pc.record.NodeSelector = nil
+	if len(pc.NodeSelector) == 0 {
+		return nil, nil
+	}
+	if pc.Pod.Spec.NodeSelector == nil {
+		pc.Pod.Spec.NodeSelector = make(map[string]string)
+	}
+	/* keys the user set are not recorded, so that they are never removed */
+	recorded := make(map[string]bool)
+	if pc.previousRecord != nil {
+		for _, key := range pc.previousRecord.NodeSelector {
+			recorded[key] = true
+		}
+	}
+	for k, v := range pc.NodeSelector {
+		if _, exists := pc.Original.Spec.NodeSelector[k]; !exists || recorded[k] {
+			pc.record.NodeSelector = append(pc.record.NodeSelector, k)
+		}
+		pc.Pod.Spec.NodeSelector[k] = v
+	}
+	sort.Strings(pc.record.NodeSelector)
+	return nil, nil
+}
+
+// mutateTolerations adds the tolerations required by the networks to the pod, unless the pod
+// has them already. Tolerations recorded by a previous mutation are removed first.
+func mutateTolerations(ctx context.Context, pc *PodContext) ([]string, error) {
+	if pc.previousRecord != nil {
+		for _, toleration := range pc.previousRecord.Tolerations {
+			removeToleration(pc.Pod, toleration)
+		}
+	}
+	pc.record.Tolerations = nil
+	for _, toleration := range pc.Tolerations {
+		if hasToleration(pc.Pod.Spec.Tolerations, toleration) {
+			continue
+		}
+		pc.Pod.Spec.Tolerations = append(pc.Pod.Spec.Tolerations, toleration)
+		pc.record.Tolerations = append(pc.record.Tolerations, toleration)
+	}
+	return nil, nil
+}
+
+/* sameToleration tells if two tolerations are equal, the empty operator meaning Equal */
+func sameToleration(a, b corev1.Toleration) bool {
+	operator := func(t corev1.Toleration) corev1.TolerationOperator {
+		if t.Operator == "" {
+			return corev1.TolerationOpEqual
+		}
+		return t.Operator
+	}
+	if a.Key != b.Key || operator(a) != operator(b) || a.Value != b.Value || a.Effect != b.Effect {
+		return false
+	}
+	if a.TolerationSeconds == nil || b.TolerationSeconds == nil {
+		return a.TolerationSeconds == b.TolerationSeconds
+	}
+	return *a.TolerationSeconds == *b.TolerationSeconds
+}
+
+/* hasToleration tells if the list holds the toleration */
+func hasToleration(tolerations []corev1.Toleration, toleration corev1.Toleration) bool {
+	for _, t := range tolerations {
+		if sameToleration(t, toleration) {
+			return true
+		}
+	}
+	return false
+}
+
+/* removeToleration removes the toleration from the pod */
+func removeToleration(pod *corev1.Pod, toleration corev1.Toleration) {
+	for i := range pod.Spec.Tolerations {
+		if sameToleration(pod.Spec.Tolerations[i], toleration) {
+			pod.Spec.Tolerations = append(pod.Spec.Tolerations[:i], pod.Spec.Tolerations[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+/* getInjectionRecord returns the record of a previous mutation of the pod, or nil if there is none */
+func getInjectionRecord(pod *corev1.Pod) (*types.InjectionRecord, error) {
+	value, ok := pod.Annotations[types.InjectionRecordAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	record := &types.InjectionRecord{}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", types.InjectionRecordAnnotation)
+	}
+	return record, nil
+}
+
+/* setInjectionRecord stores the record in the pod annotations, an empty record removes the annotation */
+func setInjectionRecord(pod *corev1.Pod, record *types.InjectionRecord) error {
+	if record.IsEmpty() {
+		delete(pod.Annotations, types.InjectionRecordAnnotation)
+		return nil
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[types.InjectionRecordAnnotation] = string(value)
+	return nil
+}
+
+/* subtractResource removes count from a resource list entry and drops the entry once nothing is left */
+func subtractResource(resources corev1.ResourceList, name corev1.ResourceName, count int64) {
+	subtractQuantity(resources, name, *resource.NewQuantity(count, resource.DecimalSI))
+}
+
+/* subtractQuantity removes amount from a resource list entry and drops the entry once nothing is left */
+func subtractQuantity(resources corev1.ResourceList, name corev1.ResourceName, amount resource.Quantity) {
+	quantity, ok := resources[name]
+	if !ok {
+		return
+	}
+	quantity.Sub(amount)
+	if quantity.Sign() <= 0 {
+		delete(resources, name)
+		return
+	}
+	resources[name] = quantity
+}
+
+// removeNetworkResources undoes a previous injection of resources into a container. With
+// honor the recorded counts are subtracted from the existing amounts, otherwise the
+// resources were overwritten and are removed.
+func removeNetworkResources(container *corev1.Container, resources map[string]int64, honor bool) {
+	for name, count := range resources {
+		resourceName := corev1.ResourceName(name)
+		if honor {
+			subtractResource(container.Resources.Requests, resourceName, count)
+			subtractResource(container.Resources.Limits, resourceName, count)
+			continue
+		}
+		delete(container.Resources.Requests, resourceName)
+		delete(container.Resources.Limits, resourceName)
+	}
+}
+
+/* removeResourceOverhead undoes a previous injection of resource overhead into a container */
+func removeResourceOverhead(container *corev1.Container, record *types.InjectionRecord) {
+	for name, quantity := range record.OverheadRequests {
+		subtractQuantity(container.Resources.Requests, name, quantity)
+	}
+	for name, quantity := range record.OverheadLimits {
+		subtractQuantity(container.Resources.Limits, name, quantity)
+	}
+}
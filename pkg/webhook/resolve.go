@@ -0,0 +1,154 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+	multus "gopkg.in/intel/multus-cni.v3/types"
+)
+
+// Reasons why a network selection could not be resolved
+const (
+	networkErrorNotFound  = "NotFound"
+	networkErrorForbidden = "Forbidden"
+	networkErrorTimeout   = "Timeout"
+	networkErrorInvalid   = "Invalid"
+	networkErrorUnknown   = "Unknown"
+)
+
+/* networkError is a failure to resolve a network selection of the pod */
+type networkError struct {
+	selection *multus.NetworkSelectionElement
+	reason    string
+	err       error
+}
+
+func (e *networkError) Error() string {
+	return fmt.Sprintf("network '%s/%s' could not be resolved (%s): %v",
+		e.selection.Namespace, e.selection.Name, e.reason, e.err)
+}
+
+/* classifyNetworkError returns the reason of a failed network attachment definition lookup */
+func classifyNetworkError(err error) string {
+	cause := errors.Cause(err)
+	switch {
+	case apierrors.IsNotFound(cause):
+		return networkErrorNotFound
+	case apierrors.IsForbidden(cause), apierrors.IsUnauthorized(cause):
+		return networkErrorForbidden
+	case apierrors.IsTimeout(cause), apierrors.IsServerTimeout(cause), cause == context.DeadlineExceeded:
+		return networkErrorTimeout
+	}
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return networkErrorTimeout
+	}
+	return networkErrorUnknown
+}
+
+/* networkLookup is the result of looking up a network attachment definition */
+type networkLookup struct {
+	nad *cniv1.NetworkAttachmentDefinition
+	err error
+}
+
+// lookupNetworks looks up the network attachment definitions referenced by the selections.
+// Each definition is fetched once, at most concurrency of them at the same time. The
+// results are keyed by "namespace/name".
+func (wh *Webhook) lookupNetworks(ctx context.Context, selections []*multus.NetworkSelectionElement, concurrency int) map[string]*networkLookup {
+	lookups := make(map[string]*networkLookup)
+	var keys []string
+	for _, selection := range selections {
+		key := selection.Namespace + "/" + selection.Name
+		if _, ok := lookups[key]; !ok {
+			lookups[key] = &networkLookup{}
+			keys = append(keys, key)
+		}
+	}
+
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string, lookup *networkLookup) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			namespace, name := splitNetworkKey(key)
+			lookup.nad, lookup.err = wh.getNetworkAttachmentDefinition(ctx, namespace, name)
+		}(key, lookups[key])
+	}
+	wg.Wait()
+	return lookups
+}
+
+/* splitNetworkKey returns the namespace and name of a "namespace/name" key */
+func splitNetworkKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1]
+}
+
+// resolveNetworks looks up the network attachment definitions of all selections and collects
+// the failures. The results follow the order of the selections. resourceCounts holds the
+// resource counts set by the selections.
+func (wh *Webhook) resolveNetworks(ctx context.Context, selections []*multus.NetworkSelectionElement,
+	resourceCounts map[*multus.NetworkSelectionElement]int64, config *types.NRIConfiguration) ([]*NetworkResources, []*networkError) {
+	lookups := wh.lookupNetworks(ctx, selections, config.MaxConcurrentNetworkLookups)
+
+	var networks []*NetworkResources
+	var failures []*networkError
+	for _, selection := range selections {
+		lookup := lookups[selection.Namespace+"/"+selection.Name]
+		if lookup.err != nil {
+			failures = append(failures, &networkError{selection: selection, reason: classifyNetworkError(lookup.err), err: lookup.err})
+			continue
+		}
+		network, err := parseNetworkAttachDefinition(lookup.nad, selection, resourceCounts[selection], config)
+		if err != nil {
+			failures = append(failures, &networkError{selection: selection, reason: networkErrorInvalid, err: err})
+			continue
+		}
+		networks = append(networks, network)
+	}
+	for _, failure := range failures {
+		glog.Error(failure)
+		networkResolutionFailuresTotal.WithLabelValues(failure.reason).Inc()
+	}
+	return networks, failures
+}
+
+/* joinNetworkErrors returns the messages of all failures */
+func joinNetworkErrors(failures []*networkError) []string {
+	var messages []string
+	for _, failure := range failures {
+		messages = append(messages, failure.Error())
+	}
+	return messages
+}
+
+/* describeNetworkErrors returns a single message describing all failures */
+func describeNetworkErrors(failures []*networkError) string {
+	return strings.Join(joinNetworkErrors(failures), "; ")
+}
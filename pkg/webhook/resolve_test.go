@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	multus "gopkg.in/intel/multus-cni.v3/types"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+/* slowNetAttachDefGetter delays every lookup to simulate the API server latency */
+type slowNetAttachDefGetter struct {
+	*fakeNetAttachDefGetter
+	delay    time.Duration
+	mutex    sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (g *slowNetAttachDefGetter) Get(ctx context.Context, namespace, name string) (*cniv1.NetworkAttachmentDefinition, error) {
+	g.mutex.Lock()
+	g.inFlight++
+	if g.inFlight > g.peak {
+		g.peak = g.inFlight
+	}
+	g.mutex.Unlock()
+	defer func() {
+		g.mutex.Lock()
+		g.inFlight--
+		g.mutex.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(g.delay):
+	}
+	return g.fakeNetAttachDefGetter.Get(ctx, namespace, name)
+}
+
+/* newSlowGetter serves count networks named net-0 to net-<count-1>, each requesting its own resource */
+func newSlowGetter(count int, delay time.Duration) *slowNetAttachDefGetter {
+	var nads []*cniv1.NetworkAttachmentDefinition
+	for i := 0; i < count; i++ {
+		nads = append(nads, newNetAttachDef("default", fmt.Sprintf("net-%d", i), map[string]string{
+			"k8s.v1.cni.cncf.io/resourceName": fmt.Sprintf("example.com/nic-%d", i),
+		}))
+	}
+	return &slowNetAttachDefGetter{fakeNetAttachDefGetter: newFakeNetAttachDefGetter(nads...), delay: delay}
+}
+
+func newSelections(names ...string) []*multus.NetworkSelectionElement {
+	var selections []*multus.NetworkSelectionElement
+	for _, name := range names {
+		selections = append(selections, &multus.NetworkSelectionElement{Namespace: "default", Name: name})
+	}
+	return selections
+}
+
+var _ = Describe("Resolving networks", func() {
+	var getter *slowNetAttachDefGetter
+	var wh *Webhook
+	var config *types.NRIConfiguration
+
+	BeforeEach(func() {
+		getter = newSlowGetter(16, 10*time.Millisecond)
+		var err error
+		wh, err = NewWebhook(Options{NetworkAttachmentDefinitions: getter})
+		Expect(err).NotTo(HaveOccurred())
+		config = types.NewNRIConfiguration()
+	})
+
+	It("should look up each network once", func() {
+		networks, failures := wh.resolveNetworks(context.TODO(), newSelections("net-1", "net-2", "net-1"), nil, config)
+		Expect(failures).To(BeEmpty())
+		Expect(networks).To(HaveLen(3))
+		Expect(getter.calls).To(Equal(2))
+	})
+
+	It("should keep the order of the selections", func() {
+		names := []string{"net-9", "unknown", "net-3", "net-0", "net-15", "net-7"}
+		networks, failures := wh.resolveNetworks(context.TODO(), newSelections(names...), nil, config)
+		var resolved []string
+		for _, network := range networks {
+			resolved = append(resolved, network.Selection.Name)
+		}
+		Expect(resolved).To(Equal([]string{"net-9", "net-3", "net-0", "net-15", "net-7"}))
+		Expect(failures).To(HaveLen(1))
+		Expect(failures[0].selection.Name).To(Equal("unknown"))
+	})
+
+	It("should bound the number of concurrent lookups", func() {
+		config.MaxConcurrentNetworkLookups = 3
+		var names []string
+		for i := 0; i < 16; i++ {
+			names = append(names, fmt.Sprintf("net-%d", i))
+		}
+		networks, failures := wh.resolveNetworks(context.TODO(), newSelections(names...), nil, config)
+		Expect(failures).To(BeEmpty())
+		Expect(networks).To(HaveLen(16))
+		Expect(getter.peak).To(Equal(3))
+	})
+})
+
+// BenchmarkResolveNetworks resolves the 16 networks of a pod against an API server
+// answering in one millisecond, looking them up one at a time and in parallel
+func BenchmarkResolveNetworks(b *testing.B) {
+	var names []string
+	for i := 0; i < 16; i++ {
+		names = append(names, fmt.Sprintf("net-%d", i))
+	}
+	selections := newSelections(names...)
+
+	for _, concurrency := range []int{1, 4, types.DefaultMaxConcurrentNetworkLookups, 16} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			wh, err := NewWebhook(Options{NetworkAttachmentDefinitions: newSlowGetter(16, time.Millisecond)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			config := types.NewNRIConfiguration()
+			config.MaxConcurrentNetworkLookups = concurrency
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, failures := wh.resolveNetworks(context.TODO(), selections, nil, config); len(failures) > 0 {
+					b.Fatal(describeNetworkErrors(failures))
+				}
+			}
+		})
+	}
+}
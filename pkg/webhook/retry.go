@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/k8snetworkplumbingwg/network-resources-injector/pkg/types"
+)
+
+/* defaultAPIBackoff paces the retries of API calls failing with transient errors */
+var defaultAPIBackoff = wait.Backoff{
+	Duration: 50 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    5,
+	Cap:      time.Second,
+}
+
+// requestTimeout returns the time available for API calls while handling a request.
+// A tenth of the webhook timeout is kept to send the response back to the API server.
+func requestTimeout(config *types.NRIConfiguration) time.Duration {
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	return timeout - timeout/10
+}
+
+/* isTransientError tells if an API call failing with err may succeed when retried */
+func isTransientError(err error) bool {
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false
+	}
+	if _, ok := cause.(apierrors.APIStatus); ok {
+		return apierrors.IsTimeout(cause) || apierrors.IsServerTimeout(cause) ||
+			apierrors.IsTooManyRequests(cause) || apierrors.IsServiceUnavailable(cause) ||
+			apierrors.IsInternalError(cause) || apierrors.IsUnexpectedServerError(cause)
+	}
+	/* no answer from the API server, e.g. connection refused or reset */
+	return true
+}
+
+// retry calls fn until it succeeds, fails with a permanent error, the backoff steps are
+// used up or the next attempt would not start before the deadline of ctx. Running out of
+// time is reported as context.DeadlineExceeded.
+func (wh *Webhook) retry(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	backoff := wh.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "%s gave up after %d attempts, last error: %v", operation, attempt, err)
+		}
+		if !isTransientError(err) {
+			return err
+		}
+		if backoff.Steps < 1 {
+			return errors.Wrapf(err, "%s failed after %d attempts", operation, attempt)
+		}
+		delay := backoff.Step()
+		if deadline, ok := ctx.Deadline(); ok && wh.clock.Now().Add(delay).After(deadline) {
+			return errors.Wrapf(context.DeadlineExceeded, "%s gave up after %d attempts, last error: %v", operation, attempt, err)
+		}
+		glog.Warningf("%s failed, retrying in %v: %v", operation, delay, err)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s gave up after %d attempts, last error: %v", operation, attempt, err)
+		case <-wh.clock.After(delay):
+		}
+	}
+}
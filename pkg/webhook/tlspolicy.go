@@ -0,0 +1,230 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names of the TLS profiles. Default keeps the settings of earlier releases.
+// Old, Intermediate and Modern follow the Mozilla server side TLS guidelines as
+// used by Kubernetes distributions, FIPS only allows algorithms approved by FIPS 140-2.
+const (
+	TLSProfileDefault      = "Default"
+	TLSProfileOld          = "Old"
+	TLSProfileIntermediate = "Intermediate"
+	TLSProfileModern       = "Modern"
+	TLSProfileFIPS         = "FIPS"
+)
+
+// TLSPolicy holds the TLS versions and algorithms accepted by the server
+type TLSPolicy struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+}
+
+var tlsVersions = map[string]uint16{
+	"VersionTLS10": tls.VersionTLS10,
+	"VersionTLS11": tls.VersionTLS11,
+	"VersionTLS12": tls.VersionTLS12,
+	"VersionTLS13": tls.VersionTLS13,
+}
+
+// cipher suites configurable for TLS 1.2 and older, TLS 1.3 suites are not configurable
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":                 tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":               tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+var tlsProfiles = map[string]TLSPolicy{
+	TLSProfileDefault: {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384},
+	},
+	TLSProfileOld: {
+		MinVersion: tls.VersionTLS10,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521},
+	},
+	TLSProfileIntermediate: {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	TLSProfileModern: {
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	/* TLS 1.3 is excluded because its cipher suites, including ChaCha20, cannot be restricted */
+	TLSProfileFIPS: {
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521},
+	},
+}
+
+func supportedNames(m interface{}) string {
+	var names []string
+	switch m := m.(type) {
+	case map[string]uint16:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string]tls.CurveID:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string]TLSPolicy:
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// NewTLSPolicy builds a TLS policy from a profile name. The versions, cipher suites and
+// curves take precedence over the profile when set. An empty profile means Default.
+func NewTLSPolicy(profile, minVersion, maxVersion string, cipherSuites, curves []string) (*TLSPolicy, error) {
+	if profile == "" {
+		profile = TLSProfileDefault
+	}
+	preset, ok := tlsProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS profile '%s', supported profiles: %s", profile, supportedNames(tlsProfiles))
+	}
+	policy := &TLSPolicy{
+		MinVersion:       preset.MinVersion,
+		MaxVersion:       preset.MaxVersion,
+		CipherSuites:     append([]uint16{}, preset.CipherSuites...),
+		CurvePreferences: append([]tls.CurveID{}, preset.CurvePreferences...),
+	}
+
+	if minVersion != "" {
+		if policy.MinVersion, ok = tlsVersions[minVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s', supported versions: %s", minVersion, supportedNames(tlsVersions))
+		}
+	}
+	if maxVersion != "" {
+		if policy.MaxVersion, ok = tlsVersions[maxVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s', supported versions: %s", maxVersion, supportedNames(tlsVersions))
+		}
+	}
+	if policy.MaxVersion != 0 && policy.MaxVersion < policy.MinVersion {
+		return nil, fmt.Errorf("maximum TLS version is lower than the minimum TLS version")
+	}
+
+	if len(cipherSuites) > 0 {
+		policy.CipherSuites = nil
+		for _, name := range cipherSuites {
+			id, ok := tlsCipherSuites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS cipher suite '%s', supported cipher suites: %s", name, supportedNames(tlsCipherSuites))
+			}
+			policy.CipherSuites = append(policy.CipherSuites, id)
+		}
+	}
+	if len(curves) > 0 {
+		policy.CurvePreferences = nil
+		for _, name := range curves {
+			id, ok := tlsCurves[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS curve '%s', supported curves: %s", name, supportedNames(tlsCurves))
+			}
+			policy.CurvePreferences = append(policy.CurvePreferences, id)
+		}
+	}
+
+	if policy.MinVersion < tls.VersionTLS13 && len(policy.CipherSuites) == 0 {
+		return nil, fmt.Errorf("at least one cipher suite is required for TLS versions older than 1.3")
+	}
+
+	return policy, nil
+}
+
+// Apply sets the versions and algorithms of the policy in a TLS configuration
+func (policy *TLSPolicy) Apply(config *tls.Config) {
+	config.MinVersion = policy.MinVersion
+	config.MaxVersion = policy.MaxVersion
+	config.CipherSuites = policy.CipherSuites
+	config.CurvePreferences = policy.CurvePreferences
+}
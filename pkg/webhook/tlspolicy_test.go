@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"crypto/tls"
+)
+
+var _ = Describe("TLS policy", func() {
+	DescribeTable("Building a TLS policy",
+		func(profile, minVersion, maxVersion string, cipherSuites, curves []string, out *TLSPolicy, shouldFail bool) {
+			policy, err := NewTLSPolicy(profile, minVersion, maxVersion, cipherSuites, curves)
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy.MinVersion).To(Equal(out.MinVersion))
+			Expect(policy.MaxVersion).To(Equal(out.MaxVersion))
+			if out.CipherSuites != nil {
+				Expect(policy.CipherSuites).To(Equal(out.CipherSuites))
+			}
+			if out.CurvePreferences != nil {
+				Expect(policy.CurvePreferences).To(Equal(out.CurvePreferences))
+			}
+		},
+		Entry("default profile", "", "", "", nil, nil,
+			&TLSPolicy{
+				MinVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				},
+				CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384},
+			}, false),
+		Entry("intermediate profile", "Intermediate", "", "", nil, nil,
+			&TLSPolicy{MinVersion: tls.VersionTLS12, CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}}, false),
+		Entry("modern profile", "Modern", "", "", nil, nil,
+			&TLSPolicy{MinVersion: tls.VersionTLS13}, false),
+		Entry("FIPS profile", "FIPS", "", "", nil, nil,
+			&TLSPolicy{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12, CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}}, false),
+		Entry("overridden versions, cipher suites and curves", "Old", "VersionTLS12", "VersionTLS13",
+			[]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, []string{"X25519", "P-521"},
+			&TLSPolicy{
+				MinVersion:       tls.VersionTLS12,
+				MaxVersion:       tls.VersionTLS13,
+				CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+				CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP521},
+			}, false),
+		Entry("unknown profile", "Paranoid", "", "", nil, nil, nil, true),
+		Entry("unknown version", "", "VersionTLS14", "", nil, nil, nil, true),
+		Entry("maximum lower than minimum", "", "VersionTLS13", "VersionTLS12", nil, nil, nil, true),
+		Entry("unknown cipher suite", "", "", "", []string{"TLS_NULL_WITH_NULL_NULL"}, nil, nil, true),
+		Entry("unknown curve", "", "", "", nil, []string{"P-192"}, nil, true),
+	)
+})
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -32,19 +33,24 @@ type tlsKeypairReloader struct {
 }
 
 type clientCertPool struct {
+	poolMutex sync.RWMutex
 	certPool  *x509.CertPool
 	certPaths *ClientCAFlags
 	insecure  bool
 }
 
-type ClientCAFlags []string
+// StringFlags is a repeatable string flag, e.g. the client CA files or the allowed client identities
+type StringFlags []string
 
-func (i *ClientCAFlags) String() string {
+// ClientCAFlags holds the paths of the client CA files
+type ClientCAFlags = StringFlags
+
+func (i *StringFlags) String() string {
 	return ""
 }
 
-func (i *ClientCAFlags) Set(path string) error {
-	*i = append(*i, path)
+func (i *StringFlags) Set(value string) error {
+	*i = append(*i, value)
 	return nil
 }
 
@@ -108,29 +114,68 @@ func (pool *clientCertPool) Load() error {
 		return fmt.Errorf("no client CA file path(s) found")
 	}
 
-	pool.certPool = x509.NewCertPool()
+	certPool := x509.NewCertPool()
 	for _, path := range *pool.certPaths {
 		caCertPem, err := ioutil.ReadFile(path)
 		if err != nil {
 			return fmt.Errorf("failed to load client CA file from path '%s'", path)
 		}
-		if ok := pool.certPool.AppendCertsFromPEM(caCertPem); !ok {
+		if ok := certPool.AppendCertsFromPEM(caCertPem); !ok {
 			return fmt.Errorf("failed to parse client CA file from path '%s'", path)
 		}
 		glog.Infof("added client CA to cert pool from path '%s'", path)
 	}
+	pool.poolMutex.Lock()
+	defer pool.poolMutex.Unlock()
+	pool.certPool = certPool
 	glog.Infof("added '%d' client CA(s) to cert pool", len(*pool.certPaths))
 	return nil
 }
 
+//Reload rebuilds the client CA pool from its files. The current pool is kept if loading fails.
+func (pool *clientCertPool) Reload() error {
+	if pool.insecure {
+		return nil
+	}
+	if err := pool.Load(); err != nil {
+		glog.Errorf("failed to reload client CA pool, keeping the current pool: %v", err)
+		clientCAReloadsTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+	glog.Infof("client CA pool reloaded")
+	clientCAReloadsTotal.WithLabelValues("success").Inc()
+	clientCALastReloadSuccess.Set(float64(time.Now().Unix()))
+	return nil
+}
+
 //GetCertPool returns a client CA pool
 func (pool *clientCertPool) GetCertPool() *x509.CertPool {
 	if pool.insecure {
 		return nil
 	}
+	pool.poolMutex.RLock()
+	defer pool.poolMutex.RUnlock()
 	return pool.certPool
 }
 
+//GetConfigForClientFunc returns a function handing out a copy of the server TLS config
+//with the current client CA pool, so rotated client CAs apply to new connections.
+func (pool *clientCertPool) GetConfigForClientFunc(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+		clientConfig := config.Clone()
+		clientConfig.ClientCAs = pool.GetCertPool()
+		return clientConfig, nil
+	}
+}
+
+//GetCertPaths returns the paths of the client CA files
+func (pool *clientCertPool) GetCertPaths() []string {
+	if pool.insecure {
+		return nil
+	}
+	return *pool.certPaths
+}
+
 //GetClientAuth determines the policy the http server will follow for TLS Client Authentication
 func GetClientAuth(insecure bool) tls.ClientAuthType {
 	if insecure {
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+/* newCA returns a self-signed CA certificate in PEM format and its raw subject */
+func newCA(commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), cert.RawSubject
+}
+
+var _ = Describe("Client CA pool", func() {
+	var dir, path string
+	var oldPEM, oldSubject []byte
+	var getConfigForClient func(*tls.ClientHelloInfo) (*tls.Config, error)
+	var pool *clientCertPool
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nri-client-ca")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "ca.crt")
+		oldPEM, oldSubject = newCA("old-ca")
+		Expect(ioutil.WriteFile(path, oldPEM, 0600)).To(Succeed())
+
+		pool, err = NewClientCertPool(&ClientCAFlags{path}, false)
+		Expect(err).NotTo(HaveOccurred())
+		getConfigForClient = pool.GetConfigForClientFunc(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	clientCASubjects := func() [][]byte {
+		config, err := getConfigForClient(&tls.ClientHelloInfo{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+		return config.ClientCAs.Subjects()
+	}
+
+	It("should hand out the client CAs loaded at start", func() {
+		Expect(clientCASubjects()).To(Equal([][]byte{oldSubject}))
+	})
+
+	It("should hand out a rotated client CA to the next client", func() {
+		newPEM, newSubject := newCA("new-ca")
+		Expect(ioutil.WriteFile(path, newPEM, 0600)).To(Succeed())
+		successes := testutil.ToFloat64(clientCAReloadsTotal.WithLabelValues("success"))
+
+		Expect(pool.Reload()).To(Succeed())
+		Expect(clientCASubjects()).To(Equal([][]byte{newSubject}))
+		Expect(testutil.ToFloat64(clientCAReloadsTotal.WithLabelValues("success"))).To(Equal(successes + 1))
+	})
+
+	It("should keep the current client CAs if the reload fails", func() {
+		Expect(ioutil.WriteFile(path, []byte("not a certificate"), 0600)).To(Succeed())
+		failures := testutil.ToFloat64(clientCAReloadsTotal.WithLabelValues("failure"))
+
+		Expect(pool.Reload()).NotTo(Succeed())
+		Expect(clientCASubjects()).To(Equal([][]byte{oldSubject}))
+		Expect(testutil.ToFloat64(clientCAReloadsTotal.WithLabelValues("failure"))).To(Equal(failures + 1))
+	})
+})
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+const (
+	watcherDebounceInterval = 100 * time.Millisecond
+	watcherMinRetryInterval = 500 * time.Millisecond
+	watcherMaxRetryInterval = 30 * time.Second
+)
+
+// FileWatcher calls reload whenever the content of a set of files changes.
+// It watches the parent directories instead of the files themselves, so that
+// atomic renames and the '..data' symlink swaps done by the kubelet when
+// updating Secret and ConfigMap volumes are noticed. File checksums are
+// compared on every event and on a periodic poll, which acts as a backstop
+// for missed events. A failing reload, e.g. on a half-written key pair, is
+// retried with backoff until it succeeds or the files change again.
+type FileWatcher struct {
+	paths        []string
+	pollInterval time.Duration
+	reload       func() error
+	checksums    map[string][sha256.Size]byte
+}
+
+// NewFileWatcher creates a watcher for paths. The files are expected to be
+// loaded already, so reload is only called once their content changes.
+func NewFileWatcher(paths []string, pollInterval time.Duration, reload func() error) *FileWatcher {
+	return &FileWatcher{
+		paths:        paths,
+		pollInterval: pollInterval,
+		reload:       reload,
+	}
+}
+
+// Run watches the files until stop is closed
+func (w *FileWatcher) Run(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := make(map[string]bool)
+	for _, path := range w.paths {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+		dirs[dir] = true
+		glog.V(2).Infof("watching directory '%s'", dir)
+	}
+
+	/* files which cannot be read yet are picked up by the first check */
+	w.checksums, _ = w.getChecksums()
+
+	poll := time.NewTicker(w.pollInterval)
+	defer poll.Stop()
+
+	var pending <-chan time.Time
+	retryInterval := watcherMinRetryInterval
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			glog.V(2).Infof("watcher event: %v", event)
+			/* coalesce the burst of events caused by a single update */
+			if pending == nil {
+				pending = time.After(watcherDebounceInterval)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			glog.Warningf("watcher error: %v", err)
+		case <-poll.C:
+			if pending == nil {
+				pending = time.After(0)
+			}
+		case <-pending:
+			pending = nil
+			if err := w.check(); err != nil {
+				glog.Warningf("failed to reload %v, retrying in %v: %v", w.paths, retryInterval, err)
+				pending = time.After(retryInterval)
+				retryInterval *= 2
+				if retryInterval > watcherMaxRetryInterval {
+					retryInterval = watcherMaxRetryInterval
+				}
+				continue
+			}
+			retryInterval = watcherMinRetryInterval
+		}
+	}
+}
+
+// check reloads the files if any of their checksums differs from the last successful reload
+func (w *FileWatcher) check() error {
+	checksums, err := w.getChecksums()
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(checksums, w.checksums) {
+		return nil
+	}
+	glog.Infof("content of %v changed, reloading", w.paths)
+	if err := w.reload(); err != nil {
+		return err
+	}
+	w.checksums = checksums
+	return nil
+}
+
+func (w *FileWatcher) getChecksums() (map[string][sha256.Size]byte, error) {
+	checksums := make(map[string][sha256.Size]byte)
+	for _, path := range w.paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		checksums[path] = sha256.Sum256(content)
+	}
+	return checksums, nil
+}
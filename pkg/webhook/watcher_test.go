@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("File watcher", func() {
+	var (
+		dir     string
+		stop    chan struct{}
+		reloads int32
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nri-watcher")
+		Expect(err).NotTo(HaveOccurred())
+		stop = make(chan struct{})
+		atomic.StoreInt32(&reloads, 0)
+	})
+
+	AfterEach(func() {
+		close(stop)
+		os.RemoveAll(dir)
+	})
+
+	run := func(w *FileWatcher) {
+		go func() {
+			defer GinkgoRecover()
+			Expect(w.Run(stop)).To(Succeed())
+		}()
+		/* give the watcher time to register and compute the initial checksums */
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	Context("when a watched file is rewritten", func() {
+		It("should reload once its content changes", func() {
+			path := filepath.Join(dir, "tls.crt")
+			Expect(ioutil.WriteFile(path, []byte("old"), 0600)).To(Succeed())
+			run(NewFileWatcher([]string{path}, time.Hour, func() error {
+				atomic.AddInt32(&reloads, 1)
+				return nil
+			}))
+
+			Expect(ioutil.WriteFile(path, []byte("new"), 0600)).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&reloads) }, 2*time.Second).Should(Equal(int32(1)))
+			Consistently(func() int32 { return atomic.LoadInt32(&reloads) }, 500*time.Millisecond).Should(Equal(int32(1)))
+		})
+	})
+
+	Context("when a Secret volume swaps its '..data' symlink", func() {
+		It("should reload", func() {
+			Expect(os.Mkdir(filepath.Join(dir, "..2021_01_01"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "..2021_01_01", "tls.crt"), []byte("old"), 0600)).To(Succeed())
+			Expect(os.Symlink("..2021_01_01", filepath.Join(dir, "..data"))).To(Succeed())
+			path := filepath.Join(dir, "tls.crt")
+			Expect(os.Symlink(filepath.Join("..data", "tls.crt"), path)).To(Succeed())
+			run(NewFileWatcher([]string{path}, time.Hour, func() error {
+				atomic.AddInt32(&reloads, 1)
+				return nil
+			}))
+
+			Expect(os.Mkdir(filepath.Join(dir, "..2021_01_02"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "..2021_01_02", "tls.crt"), []byte("new"), 0600)).To(Succeed())
+			Expect(os.Symlink("..2021_01_02", filepath.Join(dir, "..data_tmp"))).To(Succeed())
+			Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&reloads) }, 2*time.Second).Should(Equal(int32(1)))
+		})
+	})
+
+	Context("when reloading fails", func() {
+		It("should retry until the reload succeeds", func() {
+			path := filepath.Join(dir, "tls.key")
+			Expect(ioutil.WriteFile(path, []byte("old"), 0600)).To(Succeed())
+			run(NewFileWatcher([]string{path}, time.Hour, func() error {
+				if atomic.AddInt32(&reloads, 1) < 3 {
+					return errors.New("half-written key pair")
+				}
+				return nil
+			}))
+
+			Expect(ioutil.WriteFile(path, []byte("new"), 0600)).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&reloads) }, 5*time.Second).Should(Equal(int32(3)))
+			Consistently(func() int32 { return atomic.LoadInt32(&reloads) }, 2*time.Second).Should(Equal(int32(3)))
+		})
+	})
+
+	Context("when file system events are missed", func() {
+		It("should reload on the next periodic check only if the content changed", func() {
+			path := filepath.Join(dir, "ca.crt")
+			Expect(ioutil.WriteFile(path, []byte("old"), 0600)).To(Succeed())
+			w := NewFileWatcher([]string{path}, time.Hour, func() error {
+				atomic.AddInt32(&reloads, 1)
+				return nil
+			})
+			/* simulate a missed event by changing the file without a running watcher */
+			w.checksums, _ = w.getChecksums()
+			Expect(ioutil.WriteFile(path, []byte("new"), 0600)).To(Succeed())
+			Expect(w.check()).To(Succeed())
+			Expect(atomic.LoadInt32(&reloads)).To(Equal(int32(1)))
+			Expect(w.check()).To(Succeed())
+			Expect(atomic.LoadInt32(&reloads)).To(Equal(int32(1)))
+		})
+	})
+})
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
@@ -39,6 +40,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -63,16 +66,116 @@ type hugepageResourceData struct {
 const (
 	networksAnnotationKey       = "k8s.v1.cni.cncf.io/networks"
 	nodeSelectorKey             = "k8s.v1.cni.cncf.io/nodeSelector"
+	resourceCountKey            = "k8s.v1.cni.cncf.io/resourceCount"
+	resourcesKey                = "k8s.v1.cni.cncf.io/resources"
+	resourceOverheadKey         = "k8s.v1.cni.cncf.io/resourceOverhead"
+	hugepagesKey                = "k8s.v1.cni.cncf.io/hugepages"
+	tolerationsKey              = "k8s.v1.cni.cncf.io/tolerations"
 	defaultNetworkAnnotationKey = "v1.multus-cni.io/default-network"
+	warningsAuditAnnotationKey  = "warnings"
 )
 
-var (
-	clientset              kubernetes.Interface
-	injectHugepageDownApi  bool
-	resourceNameKeys       []string
-	honorExistingResources bool
-	userDefinedInjects     = &userDefinedInjections{Patchs: make(map[string]jsonPatchOperation)}
-)
+// NetworkAttachmentDefinitionGetter looks up network attachment definitions
+type NetworkAttachmentDefinitionGetter interface {
+	Get(ctx context.Context, namespace, name string) (*cniv1.NetworkAttachmentDefinition, error)
+}
+
+type clientsetNetAttachDefGetter struct {
+	clientset kubernetes.Interface
+}
+
+// NewNetworkAttachmentDefinitionGetter returns a getter reading network attachment definitions from the API server
+func NewNetworkAttachmentDefinitionGetter(clientset kubernetes.Interface) NetworkAttachmentDefinitionGetter {
+	return &clientsetNetAttachDefGetter{clientset: clientset}
+}
+
+func (g *clientsetNetAttachDefGetter) Get(ctx context.Context, namespace, name string) (*cniv1.NetworkAttachmentDefinition, error) {
+	path := fmt.Sprintf("/apis/k8s.cni.cncf.io/v1/namespaces/%s/network-attachment-definitions/%s", namespace, name)
+	rawNetworkAttachmentDefinition, err := g.clientset.ExtensionsV1beta1().RESTClient().Get().AbsPath(path).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	networkAttachmentDefinition := cniv1.NetworkAttachmentDefinition{}
+	json.Unmarshal(rawNetworkAttachmentDefinition, &networkAttachmentDefinition)
+
+	return &networkAttachmentDefinition, nil
+}
+
+// Options configure a Webhook
+type Options struct {
+	// Clientset is used to look up the owners of pods without namespace
+	Clientset kubernetes.Interface
+	// NetworkAttachmentDefinitions looks up networks, it is backed by Clientset if not set
+	NetworkAttachmentDefinitions NetworkAttachmentDefinitionGetter
+	// Clock measures the request handling, the real clock is used if not set
+	Clock clock.Clock
+	// Config is the initial configuration, defaults are used if not set
+	Config *types.NRIConfiguration
+	// Mutators is the mutation pipeline, DefaultMutatorRegistry is used if not set
+	Mutators *MutatorRegistry
+	// Backoff paces the retries of API calls failing with transient errors
+	Backoff *wait.Backoff
+}
+
+// Webhook mutates pods to request the resources of the networks they are attached to
+type Webhook struct {
+	clientset          kubernetes.Interface
+	nadGetter          NetworkAttachmentDefinitionGetter
+	clock              clock.Clock
+	mutators           *MutatorRegistry
+	backoff            wait.Backoff
+	userDefinedInjects *userDefinedInjections
+	/* configuration used by new requests, replaced as a whole on every update */
+	config atomic.Value
+	/* serializes updates of the configuration */
+	configMutex sync.Mutex
+}
+
+// NewWebhook creates a Webhook from options
+func NewWebhook(opts Options) (*Webhook, error) {
+	wh := &Webhook{
+		clientset:          opts.Clientset,
+		nadGetter:          opts.NetworkAttachmentDefinitions,
+		clock:              opts.Clock,
+		mutators:           opts.Mutators,
+		backoff:            defaultAPIBackoff,
+		userDefinedInjects: &userDefinedInjections{Patchs: make(map[string]jsonPatchOperation)},
+	}
+	if wh.nadGetter == nil && wh.clientset != nil {
+		wh.nadGetter = NewNetworkAttachmentDefinitionGetter(wh.clientset)
+	}
+	if wh.clock == nil {
+		wh.clock = clock.RealClock{}
+	}
+	if wh.mutators == nil {
+		wh.mutators = DefaultMutatorRegistry
+	}
+	if opts.Backoff != nil {
+		wh.backoff = *opts.Backoff
+	}
+	config := opts.Config
+	if config == nil {
+		config = types.NewNRIConfiguration()
+	}
+	if err := wh.validateConfiguration(config); err != nil {
+		return nil, err
+	}
+	wh.config.Store(config.DeepCopy())
+	return wh, nil
+}
+
+/* defaultWebhook backs the package level functions */
+var defaultWebhook, _ = NewWebhook(Options{})
+
+// ServeHTTP handles AdmissionReview requests sent with POST
+func (wh *Webhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Invalid HTTP verb requested", http.StatusMethodNotAllowed)
+		return
+	}
+	wh.Mutate(w, req)
+}
 
 func prepareAdmissionReviewResponse(allowed bool, message string, ar *v1beta1.AdmissionReview) error {
 	if ar.Request != nil {
@@ -147,7 +250,7 @@ func deserializeNetworkAttachmentDefinition(ar *v1beta1.AdmissionReview) (cniv1.
 	return netAttachDef, err
 }
 
-func deserializePod(ar *v1beta1.AdmissionReview) (corev1.Pod, error) {
+func (wh *Webhook) deserializePod(ctx context.Context, ar *v1beta1.AdmissionReview) (corev1.Pod, error) {
 	/* unmarshal Pod from AdmissionReview request */
 	pod := corev1.Pod{}
 	err := json.Unmarshal(ar.Request.Object.Raw, &pod)
@@ -156,7 +259,7 @@ func deserializePod(ar *v1beta1.AdmissionReview) (corev1.Pod, error) {
 	}
 	ownerRef := pod.ObjectMeta.OwnerReferences
 	if ownerRef != nil && len(ownerRef) > 0 {
-		namespace, err := getNamespaceFromOwnerReference(pod.ObjectMeta.OwnerReferences[0])
+		namespace, err := wh.getNamespaceFromOwnerReference(ctx, pod.ObjectMeta.OwnerReferences[0])
 		if err != nil {
 			return pod, err
 		}
@@ -165,12 +268,20 @@ func deserializePod(ar *v1beta1.AdmissionReview) (corev1.Pod, error) {
 	return pod, err
 }
 
-func getNamespaceFromOwnerReference(ownerRef metav1.OwnerReference) (namespace string, err error) {
+func (wh *Webhook) getNamespaceFromOwnerReference(ctx context.Context, ownerRef metav1.OwnerReference) (namespace string, err error) {
+	if wh.clientset == nil {
+		err = errors.New("no Kubernetes client to look up the pod owner")
+		return
+	}
+	clientset := wh.clientset
 	namespace = ""
 	switch ownerRef.Kind {
 	case "ReplicaSet":
 		var replicaSets *v1.ReplicaSetList
-		replicaSets, err = clientset.AppsV1().ReplicaSets("").List(context.TODO(), metav1.ListOptions{})
+		err = wh.retry(ctx, "listing replica sets", func(ctx context.Context) (err error) {
+			replicaSets, err = clientset.AppsV1().ReplicaSets("").List(ctx, metav1.ListOptions{})
+			return
+		})
 		if err != nil {
 			return
 		}
@@ -183,7 +294,10 @@ func getNamespaceFromOwnerReference(ownerRef metav1.OwnerReference) (namespace s
 		}
 	case "DaemonSet":
 		var daemonSets *v1.DaemonSetList
-		daemonSets, err = clientset.AppsV1().DaemonSets("").List(context.TODO(), metav1.ListOptions{})
+		err = wh.retry(ctx, "listing daemon sets", func(ctx context.Context) (err error) {
+			daemonSets, err = clientset.AppsV1().DaemonSets("").List(ctx, metav1.ListOptions{})
+			return
+		})
 		if err != nil {
 			return
 		}
@@ -196,7 +310,10 @@ func getNamespaceFromOwnerReference(ownerRef metav1.OwnerReference) (namespace s
 		}
 	case "StatefulSet":
 		var statefulSets *v1.StatefulSetList
-		statefulSets, err = clientset.AppsV1().StatefulSets("").List(context.TODO(), metav1.ListOptions{})
+		err = wh.retry(ctx, "listing stateful sets", func(ctx context.Context) (err error) {
+			statefulSets, err = clientset.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
+			return
+		})
 		if err != nil {
 			return
 		}
@@ -209,7 +326,10 @@ func getNamespaceFromOwnerReference(ownerRef metav1.OwnerReference) (namespace s
 		}
 	case "ReplicationController":
 		var replicationControllers *corev1.ReplicationControllerList
-		replicationControllers, err = clientset.CoreV1().ReplicationControllers("").List(context.TODO(), metav1.ListOptions{})
+		err = wh.retry(ctx, "listing replication controllers", func(ctx context.Context) (err error) {
+			replicationControllers, err = clientset.CoreV1().ReplicationControllers("").List(ctx, metav1.ListOptions{})
+			return
+		})
 		if err != nil {
 			return
 		}
@@ -234,12 +354,6 @@ func getNamespaceFromOwnerReference(ownerRef metav1.OwnerReference) (namespace s
 
 }
 
-func toSafeJsonPatchKey(in string) string {
-	out := strings.Replace(in, "~", "~0", -1)
-	out = strings.Replace(out, "/", "~1", -1)
-	return out
-}
-
 func parsePodNetworkSelections(podNetworks, defaultNamespace string) ([]*multus.NetworkSelectionElement, error) {
 	var networkSelections []*multus.NetworkSelectionElement
 
@@ -277,6 +391,37 @@ func parsePodNetworkSelections(podNetworks, defaultNamespace string) ([]*multus.
 	return networkSelections, nil
 }
 
+// parseResourceCountOverrides returns the resourceCount set by the selections of a JSON
+// network selection list. Multus does not know this field, so it is read separately and
+// the results are keyed by the selections parsed from the same list.
+func parseResourceCountOverrides(podNetworks string, selections []*multus.NetworkSelectionElement) (map[*multus.NetworkSelectionElement]int64, error) {
+	var elements []struct {
+		ResourceCount *int64 `json:"resourceCount"`
+	}
+	if err := json.Unmarshal([]byte(podNetworks), &elements); err != nil {
+		/* not a JSON list, comma separated selections can not override the resource count */
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, errors.Wrap(err, "resourceCount of a network selection must be an integer")
+		}
+		return nil, nil
+	}
+	if len(elements) != len(selections) {
+		return nil, nil
+	}
+	overrides := make(map[*multus.NetworkSelectionElement]int64)
+	for i, element := range elements {
+		if element.ResourceCount == nil {
+			continue
+		}
+		if *element.ResourceCount < 1 {
+			return nil, errors.Errorf("resourceCount of network selection '%s/%s' must be positive, got %d",
+				selections[i].Namespace, selections[i].Name, *element.ResourceCount)
+		}
+		overrides[selections[i]] = *element.ResourceCount
+	}
+	return overrides, nil
+}
+
 func parsePodNetworkSelectionElement(selection, defaultNamespace string) (*multus.NetworkSelectionElement, error) {
 	var namespace, name, netInterface string
 	var networkSelectionElement *multus.NetworkSelectionElement
@@ -328,306 +473,337 @@ func parsePodNetworkSelectionElement(selection, defaultNamespace string) (*multu
 	return networkSelectionElement, nil
 }
 
-func getNetworkAttachmentDefinition(namespace, name string) (*cniv1.NetworkAttachmentDefinition, error) {
-	path := fmt.Sprintf("/apis/k8s.cni.cncf.io/v1/namespaces/%s/network-attachment-definitions/%s", namespace, name)
-	rawNetworkAttachmentDefinition, err := clientset.ExtensionsV1beta1().RESTClient().Get().AbsPath(path).DoRaw(context.TODO())
+func (wh *Webhook) getNetworkAttachmentDefinition(ctx context.Context, namespace, name string) (*cniv1.NetworkAttachmentDefinition, error) {
+	if wh.nadGetter == nil {
+		return nil, errors.New("no Kubernetes client to look up network attachment definitions")
+	}
+	var networkAttachmentDefinition *cniv1.NetworkAttachmentDefinition
+	err := wh.retry(ctx, "getting Network Attachment Definition "+namespace+"/"+name, func(ctx context.Context) (err error) {
+		networkAttachmentDefinition, err = wh.nadGetter.Get(ctx, namespace, name)
+		return
+	})
 	if err != nil {
 		err := errors.Wrapf(err, "could not get Network Attachment Definition %s/%s", namespace, name)
 		glog.Error(err)
 		return nil, err
 	}
+	return networkAttachmentDefinition, nil
+}
 
-	networkAttachmentDefinition := cniv1.NetworkAttachmentDefinition{}
-	json.Unmarshal(rawNetworkAttachmentDefinition, &networkAttachmentDefinition)
-
-	return &networkAttachmentDefinition, nil
+// NetworkResources holds what a network selection of the pod requires
+type NetworkResources struct {
+	// Selection is the network selection of the pod
+	Selection *multus.NetworkSelectionElement
+	// Resources maps the resources requested by the network to their count
+	Resources map[string]int64
+	// NodeSelector holds the node labels required by the network
+	NodeSelector map[string]string
+	// Overhead holds the cpu, memory and hugepages needed by the attachment
+	Overhead corev1.ResourceList
+	// Hugepages holds the hugepages needed by the attachment, to be mounted into the pod
+	Hugepages corev1.ResourceList
+	// Tolerations holds the tolerations of the node taints of the network
+	Tolerations []corev1.Toleration
+	// Warnings describe annotations of the network which were ignored
+	Warnings []string
 }
 
-func parseNetworkAttachDefinition(net *multus.NetworkSelectionElement, reqs map[string]int64, nsMap map[string]string) (map[string]int64, map[string]string, error) {
-	/* for each network in annotation ask API server for network-attachment-definition */
-	networkAttachmentDefinition, err := getNetworkAttachmentDefinition(net.Namespace, net.Name)
-	if err != nil {
-		/* if doesn't exist: deny pod */
-		reason := errors.Wrapf(err, "could not find network attachment definition '%s/%s'", net.Namespace, net.Name)
-		glog.Error(reason)
-		return reqs, nsMap, reason
-	}
+// parseNetworkAttachDefinition returns what an attachment to a network requires. Each
+// attachment consumes the resource count declared by the net-attach-def, 1 by default,
+// unless the selection overrides it with resourceCount (0 if not set).
+func parseNetworkAttachDefinition(networkAttachmentDefinition *cniv1.NetworkAttachmentDefinition, net *multus.NetworkSelectionElement, resourceCount int64, config *types.NRIConfiguration) (*NetworkResources, error) {
 	glog.Infof("network attachment definition '%s/%s' found", net.Namespace, net.Name)
 
-	/* network object exists, so check if it contains resourceName annotation */
-	for _, networkResourceNameKey := range resourceNameKeys {
-		if resourceName, exists := networkAttachmentDefinition.ObjectMeta.Annotations[networkResourceNameKey]; exists {
-			/* add resource to map/increment if it was already there */
-			reqs[resourceName]++
-			glog.Infof("resource '%s' needs to be requested for network '%s/%s'", resourceName, net.Namespace, net.Name)
-		} else {
-			glog.Infof("network '%s/%s' doesn't use custom resources, skipping...", net.Namespace, net.Name)
-		}
+	network := &NetworkResources{
+		Selection:    net,
+		Resources:    make(map[string]int64),
+		NodeSelector: make(map[string]string),
 	}
 
-	/* parse the net-attach-def annotations for node selector label and add it to the desiredNsMap */
-	if ns, exists := networkAttachmentDefinition.ObjectMeta.Annotations[nodeSelectorKey]; exists {
-		nsNameValue := strings.Split(ns, "=")
-		nsNameValueLen := len(nsNameValue)
-		if nsNameValueLen > 2 {
-			reason := fmt.Errorf("node selector in net-attach-def %s has more than one label", net.Name)
-			glog.Error(reason)
-			return reqs, nsMap, reason
-		} else if nsNameValueLen == 2 {
-			nsMap[strings.TrimSpace(nsNameValue[0])] = strings.TrimSpace(nsNameValue[1])
-		} else {
-			nsMap[strings.TrimSpace(ns)] = ""
+	count := int64(1)
+	if value, exists := networkAttachmentDefinition.ObjectMeta.Annotations[resourceCountKey]; exists {
+		declared, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || declared < 1 {
+			return nil, fmt.Errorf("resource count '%s' in net-attach-def %s is not a positive integer", value, net.Name)
 		}
+		count = declared
 	}
-
-	return reqs, nsMap, nil
-}
-
-func handleValidationError(w http.ResponseWriter, ar *v1beta1.AdmissionReview, orgErr error) {
-	err := prepareAdmissionReviewResponse(false, orgErr.Error(), ar)
-	if err != nil {
-		err := errors.Wrap(err, "error preparing AdmissionResponse")
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if resourceCount != 0 {
+		count = resourceCount
 	}
-	writeResponse(w, ar)
-}
-
-func writeResponse(w http.ResponseWriter, ar *v1beta1.AdmissionReview) {
-	glog.Infof("sending response to the Kubernetes API server")
-	resp, _ := json.Marshal(ar)
-	w.Write(resp)
-}
-
-func patchEmptyResources(patch []jsonPatchOperation, containerIndex uint, key string) []jsonPatchOperation {
-	patch = append(patch, jsonPatchOperation{
-		Operation: "add",
-		Path:      "/spec/containers/" + fmt.Sprintf("%d", containerIndex) + "/resources/" + toSafeJsonPatchKey(key),
-		Value:     corev1.ResourceList{},
-	})
-	return patch
-}
-
-func addVolDownwardAPI(patch []jsonPatchOperation, hugepageResourceList []hugepageResourceData, pod *corev1.Pod) []jsonPatchOperation {
-	dAPIItems := []corev1.DownwardAPIVolumeFile{}
 
-	if pod.Labels != nil && len(pod.Labels) > 0 {
-		labels := corev1.ObjectFieldSelector{
-			FieldPath: "metadata.labels",
+	/* network object exists, so check if it contains resourceName annotation, the first configured key wins */
+	primaryKey := ""
+	for _, networkResourceNameKey := range config.ResourceNameKeys {
+		resourceName, exists := networkAttachmentDefinition.ObjectMeta.Annotations[networkResourceNameKey]
+		if !exists {
+			continue
 		}
-		dAPILabels := corev1.DownwardAPIVolumeFile{
-			Path:     types.LabelsPath,
-			FieldRef: &labels,
+		if primaryKey != "" {
+			network.Warnings = append(network.Warnings, fmt.Sprintf(
+				"net-attach-def %s/%s: ignoring resource '%s' of annotation '%s', annotation '%s' takes precedence",
+				net.Namespace, net.Name, resourceName, networkResourceNameKey, primaryKey))
+			continue
 		}
-		dAPIItems = append(dAPIItems, dAPILabels)
+		primaryKey = networkResourceNameKey
+		network.Resources[resourceName] = count
+		glog.Infof("%d of resource '%s' need to be requested for network '%s/%s'", count, resourceName, net.Namespace, net.Name)
 	}
 
-	if pod.Annotations != nil && len(pod.Annotations) > 0 {
-		annotations := corev1.ObjectFieldSelector{
-			FieldPath: "metadata.annotations",
+	/* additional resources listed by the network */
+	if value, exists := networkAttachmentDefinition.ObjectMeta.Annotations[resourcesKey]; exists {
+		resources, err := parseResourceList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resources in net-attach-def %s: %v", net.Name, err)
 		}
-		dAPIAnnotations := corev1.DownwardAPIVolumeFile{
-			Path:     types.AnnotationsPath,
-			FieldRef: &annotations,
+		for _, r := range resources {
+			if _, exists := network.Resources[r.name]; exists {
+				return nil, fmt.Errorf("resource '%s' of net-attach-def %s is already requested by annotation '%s'", r.name, net.Name, primaryKey)
+			}
+			network.Resources[r.name] = r.count
+			glog.Infof("%d of resource '%s' need to be requested for network '%s/%s'", r.count, r.name, net.Namespace, net.Name)
 		}
-		dAPIItems = append(dAPIItems, dAPIAnnotations)
 	}
-
-	for _, hugepageResource := range hugepageResourceList {
-		hugepageSelector := corev1.ResourceFieldSelector{
-			Resource:      hugepageResource.ResourceName,
-			ContainerName: hugepageResource.ContainerName,
-			Divisor:       *resource.NewQuantity(1*1024*1024, resource.BinarySI),
-		}
-		dAPIHugepage := corev1.DownwardAPIVolumeFile{
-			Path:             hugepageResource.Path,
-			ResourceFieldRef: &hugepageSelector,
-		}
-		dAPIItems = append(dAPIItems, dAPIHugepage)
+	if len(network.Resources) == 0 {
+		glog.Infof("network '%s/%s' doesn't use custom resources, skipping...", net.Namespace, net.Name)
 	}
 
-	dAPIVolSource := corev1.DownwardAPIVolumeSource{
-		Items: dAPIItems,
-	}
-	volSource := corev1.VolumeSource{
-		DownwardAPI: &dAPIVolSource,
-	}
-	vol := corev1.Volume{
-		Name:         "podnetinfo",
-		VolumeSource: volSource,
+	if value, exists := networkAttachmentDefinition.ObjectMeta.Annotations[resourceOverheadKey]; exists {
+		overhead, err := parseResourceOverhead(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource overhead in net-attach-def %s: %v", net.Name, err)
+		}
+		network.Overhead = overhead
 	}
 
-	patch = append(patch, jsonPatchOperation{
-		Operation: "add",
-		Path:      "/spec/volumes/-",
-		Value:     vol,
-	})
-
-	return patch
-}
-
-func addVolumeMount(patch []jsonPatchOperation, containersLen int) []jsonPatchOperation {
-
-	vm := corev1.VolumeMount{
-		Name:      "podnetinfo",
-		ReadOnly:  true,
-		MountPath: types.DownwardAPIMountPath,
-	}
-	for containerIndex := 0; containerIndex < containersLen; containerIndex++ {
-		patch = append(patch, jsonPatchOperation{
-			Operation: "add",
-			Path:      "/spec/containers/" + strconv.Itoa(containerIndex) + "/volumeMounts/-",
-			Value:     vm,
-		})
+	if value, exists := networkAttachmentDefinition.ObjectMeta.Annotations[hugepagesKey]; exists {
+		hugepages, err := parseHugepages(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hugepages in net-attach-def %s: %v", net.Name, err)
+		}
+		network.Hugepages = hugepages
 	}
 
-	return patch
-}
-
-func createVolPatch(patch []jsonPatchOperation, hugepageResourceList []hugepageResourceData, pod *corev1.Pod) []jsonPatchOperation {
-	patch = addVolumeMount(patch, len(pod.Spec.Containers))
-	patch = addVolDownwardAPI(patch, hugepageResourceList, pod)
-	return patch
-}
-
-func addEnvVar(patch []jsonPatchOperation, containerIndex int, firstElement bool,
-	envName string, envVal string) []jsonPatchOperation {
-
-	env := corev1.EnvVar{
-		Name:  envName,
-		Value: envVal,
+	if value, exists := networkAttachmentDefinition.ObjectMeta.Annotations[tolerationsKey]; exists {
+		tolerations, err := parseTolerations(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tolerations in net-attach-def %s: %v", net.Name, err)
+		}
+		network.Tolerations = tolerations
 	}
 
-	if firstElement {
-		patch = append(patch, jsonPatchOperation{
-			Operation: "add",
-			Path:      "/spec/containers/" + fmt.Sprintf("%d", containerIndex) + "/env",
-			Value:     []corev1.EnvVar{env},
-		})
-	} else {
-		patch = append(patch, jsonPatchOperation{
-			Operation: "add",
-			Path:      "/spec/containers/" + fmt.Sprintf("%d", containerIndex) + "/env/-",
-			Value:     env,
-		})
+	/* parse the net-attach-def annotations for node selector label and add it to the node selector of the network */
+	if ns, exists := networkAttachmentDefinition.ObjectMeta.Annotations[nodeSelectorKey]; exists {
+		nsNameValue := strings.Split(ns, "=")
+		nsNameValueLen := len(nsNameValue)
+		if nsNameValueLen > 2 {
+			return nil, fmt.Errorf("node selector in net-attach-def %s has more than one label", net.Name)
+		} else if nsNameValueLen == 2 {
+			network.NodeSelector[strings.TrimSpace(nsNameValue[0])] = strings.TrimSpace(nsNameValue[1])
+		} else {
+			network.NodeSelector[strings.TrimSpace(ns)] = ""
+		}
 	}
 
-	return patch
+	return network, nil
 }
 
-func createEnvPatch(patch []jsonPatchOperation, container *corev1.Container,
-	containerIndex int, envName string, envVal string) []jsonPatchOperation {
+type listedResource struct {
+	name  string
+	count int64
+}
 
-	// Determine if requested ENV already exists
-	found := false
-	firstElement := false
-	if len(container.Env) != 0 {
-		for _, env := range container.Env {
-			if env.Name == envName {
-				found = true
-				if env.Value != envVal {
-					glog.Warningf("Error, adding env '%s', name existed but value different: '%s' != '%s'",
-						envName, env.Value, envVal)
-				}
-				break
+/* parseResourceList parses a comma separated list of resources, each followed by an optional =count */
+func parseResourceList(list string) ([]listedResource, error) {
+	var resources []listedResource
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		r := listedResource{name: item, count: 1}
+		if i := strings.Index(item, "="); i >= 0 {
+			r.name = strings.TrimSpace(item[:i])
+			count, err := strconv.ParseInt(strings.TrimSpace(item[i+1:]), 10, 64)
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("count of resource '%s' is not a positive integer", r.name)
 			}
+			r.count = count
 		}
-	} else {
-		firstElement = true
+		if r.name == "" {
+			return nil, fmt.Errorf("resource name can not be empty")
+		}
+		if seen[r.name] {
+			return nil, fmt.Errorf("resource '%s' is listed more than once", r.name)
+		}
+		seen[r.name] = true
+		resources = append(resources, r)
 	}
+	return resources, nil
+}
 
-	if !found {
-		patch = addEnvVar(patch, containerIndex, firstElement, envName, envVal)
+/* parseResourceOverhead parses a comma separated list of cpu, memory and hugepages quantities, e.g. cpu=1,memory=1Gi */
+func parseResourceOverhead(list string) (corev1.ResourceList, error) {
+	overhead := corev1.ResourceList{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		nameValue := strings.SplitN(item, "=", 2)
+		if len(nameValue) != 2 {
+			return nil, fmt.Errorf("'%s' is not a resource=quantity pair", item)
+		}
+		name := corev1.ResourceName(strings.TrimSpace(nameValue[0]))
+		if name != corev1.ResourceCPU && name != corev1.ResourceMemory &&
+			!strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix) {
+			return nil, fmt.Errorf("resource '%s' is not supported, expected cpu, memory or hugepages-<size>", name)
+		}
+		if _, exists := overhead[name]; exists {
+			return nil, fmt.Errorf("resource '%s' is listed more than once", name)
+		}
+		quantity, err := resource.ParseQuantity(strings.TrimSpace(nameValue[1]))
+		if err != nil || quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("quantity of resource '%s' is not positive", name)
+		}
+		overhead[name] = quantity
 	}
-	return patch
+	return overhead, nil
 }
 
-func createNodeSelectorPatch(patch []jsonPatchOperation, existing map[string]string, desired map[string]string) []jsonPatchOperation {
-	targetMap := make(map[string]string)
-	if existing != nil {
-		for k, v := range existing {
-			targetMap[k] = v
+// parseHugepages parses a comma separated list of hugepage sizes and the amount of memory
+// in pages of that size, e.g. 1Gi=2Gi. The amount must be a multiple of the page size.
+func parseHugepages(list string) (corev1.ResourceList, error) {
+	hugepages := corev1.ResourceList{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
 		}
-	}
-	if desired != nil {
-		for k, v := range desired {
-			targetMap[k] = v
+		sizeAmount := strings.SplitN(item, "=", 2)
+		if len(sizeAmount) != 2 {
+			return nil, fmt.Errorf("'%s' is not a size=amount pair", item)
 		}
+		size, err := resource.ParseQuantity(strings.TrimSpace(sizeAmount[0]))
+		if err != nil || size.Sign() <= 0 {
+			return nil, fmt.Errorf("hugepage size '%s' is not a positive quantity", sizeAmount[0])
+		}
+		amount, err := resource.ParseQuantity(strings.TrimSpace(sizeAmount[1]))
+		if err != nil || amount.Sign() <= 0 {
+			return nil, fmt.Errorf("amount of %s hugepages is not a positive quantity", size.String())
+		}
+		if amount.Value()%size.Value() != 0 {
+			return nil, fmt.Errorf("amount %s is not a multiple of the hugepage size %s", amount.String(), size.String())
+		}
+		name := corev1.ResourceName(corev1.ResourceHugePagesPrefix + size.String())
+		if _, exists := hugepages[name]; exists {
+			return nil, fmt.Errorf("hugepage size %s is listed more than once", size.String())
+		}
+		hugepages[name] = amount
 	}
-	if len(targetMap) == 0 {
-		return patch
-	}
-	patch = append(patch, jsonPatchOperation{
-		Operation: "add",
-		Path:      "/spec/nodeSelector",
-		Value:     targetMap,
-	})
-	return patch
+	return hugepages, nil
 }
 
-func createResourcePatch(patch []jsonPatchOperation, Containers []corev1.Container, resourceRequests map[string]int64) []jsonPatchOperation {
-	/* check whether resources paths exists in the first container and add as the first patches if missing */
-	if len(Containers[0].Resources.Requests) == 0 {
-		patch = patchEmptyResources(patch, 0, "requests")
+// parseTolerations parses a JSON list of tolerations in the format of the pod spec, e.g.
+// [{"key": "sriov", "operator": "Exists", "effect": "NoSchedule"}]
+func parseTolerations(list string) ([]corev1.Toleration, error) {
+	var tolerations []corev1.Toleration
+	if err := json.Unmarshal([]byte(list), &tolerations); err != nil {
+		return nil, fmt.Errorf("not a JSON list of tolerations: %v", err)
 	}
-	if len(Containers[0].Resources.Limits) == 0 {
-		patch = patchEmptyResources(patch, 0, "limits")
+	for _, toleration := range tolerations {
+		switch toleration.Operator {
+		case corev1.TolerationOpExists:
+			if toleration.Value != "" {
+				return nil, fmt.Errorf("toleration of key '%s' with operator Exists can not have a value", toleration.Key)
+			}
+		case corev1.TolerationOpEqual, "":
+			if toleration.Key == "" {
+				return nil, fmt.Errorf("toleration without key must use operator Exists")
+			}
+		default:
+			return nil, fmt.Errorf("toleration of key '%s' has unsupported operator '%s'", toleration.Key, toleration.Operator)
+		}
+		switch toleration.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute, "":
+		default:
+			return nil, fmt.Errorf("toleration of key '%s' has unsupported effect '%s'", toleration.Key, toleration.Effect)
+		}
+		if toleration.TolerationSeconds != nil && toleration.Effect != corev1.TaintEffectNoExecute {
+			return nil, fmt.Errorf("toleration of key '%s' sets tolerationSeconds without effect NoExecute", toleration.Key)
+		}
 	}
+	return tolerations, nil
+}
 
-	resourceList := *getResourceList(resourceRequests)
-
-	for resource, quantity := range resourceList {
-		patch = appendResource(patch, resource.String(), quantity, quantity)
+/* mergeTolerations returns the tolerations of all network attachments, each once */
+func mergeTolerations(networks []*NetworkResources) []corev1.Toleration {
+	var tolerations []corev1.Toleration
+	for _, network := range networks {
+		for _, toleration := range network.Tolerations {
+			if !hasToleration(tolerations, toleration) {
+				tolerations = append(tolerations, toleration)
+			}
+		}
 	}
-
-	return patch
+	return tolerations
 }
 
-func updateResourcePatch(patch []jsonPatchOperation, Containers []corev1.Container, resourceRequests map[string]int64) []jsonPatchOperation {
-	var existingrequestsMap map[corev1.ResourceName]resource.Quantity
-	var existingLimitsMap map[corev1.ResourceName]resource.Quantity
-
-	if len(Containers[0].Resources.Requests) == 0 {
-		patch = patchEmptyResources(patch, 0, "requests")
-	} else {
-		existingrequestsMap = Containers[0].Resources.Requests
-	}
-	if len(Containers[0].Resources.Limits) == 0 {
-		patch = patchEmptyResources(patch, 0, "limits")
-	} else {
-		existingLimitsMap = Containers[0].Resources.Limits
+/* sumResourceLists returns the sum of a resource list of all network attachments */
+func sumResourceLists(networks []*NetworkResources, list func(*NetworkResources) corev1.ResourceList) corev1.ResourceList {
+	total := corev1.ResourceList{}
+	for _, network := range networks {
+		for name, quantity := range list(network) {
+			sum := total[name]
+			sum.Add(quantity)
+			total[name] = sum
+		}
 	}
+	return total
+}
 
-	resourceList := *getResourceList(resourceRequests)
-
-	for resourceName, quantity := range resourceList {
-		reqQuantity := quantity
-		limitQuantity := quantity
-		if value, ok := existingrequestsMap[resourceName]; ok {
-			reqQuantity.Add(value)
+/* sumNetworkResources returns the resources and node labels required by all networks */
+func sumNetworkResources(networks []*NetworkResources) (map[string]int64, map[string]string) {
+	resourceRequests := make(map[string]int64)
+	nodeSelector := make(map[string]string)
+	for _, network := range networks {
+		for name, count := range network.Resources {
+			resourceRequests[name] += count
 		}
-		if value, ok := existingLimitsMap[resourceName]; ok {
-			limitQuantity.Add(value)
+		for k, v := range network.NodeSelector {
+			nodeSelector[k] = v
 		}
-		patch = appendResource(patch, resourceName.String(), reqQuantity, limitQuantity)
 	}
+	return resourceRequests, nodeSelector
+}
 
-	return patch
+func handleValidationError(w http.ResponseWriter, ar *v1beta1.AdmissionReview, orgErr error) {
+	err := prepareAdmissionReviewResponse(false, orgErr.Error(), ar)
+	if err != nil {
+		err := errors.Wrap(err, "error preparing AdmissionResponse")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeResponse(w, ar)
 }
 
-func appendResource(patch []jsonPatchOperation, resourceName string, reqQuantity, limitQuantity resource.Quantity) []jsonPatchOperation {
-	patch = append(patch, jsonPatchOperation{
-		Operation: "add",
-		Path:      "/spec/containers/0/resources/requests/" + toSafeJsonPatchKey(resourceName),
-		Value:     reqQuantity,
-	})
-	patch = append(patch, jsonPatchOperation{
-		Operation: "add",
-		Path:      "/spec/containers/0/resources/limits/" + toSafeJsonPatchKey(resourceName),
-		Value:     limitQuantity,
-	})
+/* setWarnings reports warnings in the audit annotations, the v1beta1 admission API has no warnings */
+func setWarnings(ar *v1beta1.AdmissionReview, warnings []string) {
+	if len(warnings) == 0 {
+		return
+	}
+	glog.Warningf("mutation warnings: %v", warnings)
+	if ar.Response.AuditAnnotations == nil {
+		ar.Response.AuditAnnotations = make(map[string]string)
+	}
+	ar.Response.AuditAnnotations[warningsAuditAnnotationKey] = strings.Join(warnings, "; ")
+}
 
-	return patch
+func writeResponse(w http.ResponseWriter, ar *v1beta1.AdmissionReview) {
+	glog.Infof("sending response to the Kubernetes API server")
+	resp, _ := json.Marshal(ar)
+	w.Write(resp)
 }
 
 func getResourceList(resourceRequests map[string]int64) *corev1.ResourceList {
@@ -639,30 +815,14 @@ func getResourceList(resourceRequests map[string]int64) *corev1.ResourceList {
 	return &resourceList
 }
 
-func appendPodAnnotation(patch []jsonPatchOperation, pod corev1.Pod, userDefinedPatch jsonPatchOperation) []jsonPatchOperation {
-	annotMap := make(map[string]string)
-	for k, v := range pod.ObjectMeta.Annotations {
-		annotMap[k] = v
-	}
-	for k, v := range userDefinedPatch.Value.(map[string]interface{}) {
-		annotMap[k] = v.(string)
-	}
-	patch = append(patch, jsonPatchOperation{
-		Operation: "add",
-		Path:      "/metadata/annotations",
-		Value:     annotMap,
-	})
-	return patch
-}
-
-func createCustomizedPatch(pod corev1.Pod) ([]jsonPatchOperation, error) {
+func (wh *Webhook) createCustomizedPatch(pod corev1.Pod) ([]jsonPatchOperation, error) {
 	var userDefinedPatch []jsonPatchOperation
 
 	// lock for reading
-	userDefinedInjects.Lock()
-	defer userDefinedInjects.Unlock()
+	wh.userDefinedInjects.Lock()
+	defer wh.userDefinedInjects.Unlock()
 
-	for k, v := range userDefinedInjects.Patchs {
+	for k, v := range wh.userDefinedInjects.Patchs {
 		// The userDefinedInjects will be injected when:
 		// 1. Pod labels contain the patch key defined in userDefinedInjects, and
 		// 2. The value of patch key in pod labels(not in userDefinedInjects) is "true"
@@ -673,15 +833,6 @@ func createCustomizedPatch(pod corev1.Pod) ([]jsonPatchOperation, error) {
 	return userDefinedPatch, nil
 }
 
-func appendCustomizedPatch(patch []jsonPatchOperation, pod corev1.Pod, userDefinedPatch []jsonPatchOperation) []jsonPatchOperation {
-	for _, p := range userDefinedPatch {
-		if p.Path == "/metadata/annotations" {
-			patch = appendPodAnnotation(patch, pod, p)
-		}
-	}
-	return patch
-}
-
 func getNetworkSelections(annotationKey string, pod corev1.Pod, userDefinedPatch []jsonPatchOperation) (string, bool) {
 	// User defined annotateKey takes precedence than userDefined injections
 	glog.Infof("search %s in original pod annotations", annotationKey)
@@ -711,9 +862,26 @@ func getNetworkSelections(annotationKey string, pod corev1.Pod, userDefinedPatch
 
 // MutateHandler handles AdmissionReview requests and sends responses back to the K8s API server
 func MutateHandler(w http.ResponseWriter, req *http.Request) {
+	defaultWebhook.Mutate(w, req)
+}
+
+// Mutate handles AdmissionReview requests and sends responses back to the K8s API server
+func (wh *Webhook) Mutate(w http.ResponseWriter, req *http.Request) {
 	glog.Infof("Received mutation request")
 	var err error
 
+	start := wh.clock.Now()
+	defer func() {
+		mutateDurationSeconds.Observe(wh.clock.Since(start).Seconds())
+	}()
+
+	/* use the same configuration for the whole request */
+	config := wh.Configuration()
+
+	/* API calls share the time the API server waits for the response */
+	ctx, cancel := context.WithTimeout(req.Context(), requestTimeout(config))
+	defer cancel()
+
 	/* read AdmissionReview from the HTTP request */
 	ar, httpStatus, err := readAdmissionReview(req, w)
 	if err != nil {
@@ -723,13 +891,13 @@ func MutateHandler(w http.ResponseWriter, req *http.Request) {
 
 	/* read pod annotations */
 	/* if networks missing skip everything */
-	pod, err := deserializePod(ar)
+	pod, err := wh.deserializePod(ctx, ar)
 	if err != nil {
 		handleValidationError(w, ar, err)
 		return
 	}
 
-	userDefinedPatch, err := createCustomizedPatch(pod)
+	userDefinedPatch, err := wh.createCustomizedPatch(pod)
 	if err != nil {
 		glog.Warningf("Error, failed to create user-defined injection patch, %v", err)
 	}
@@ -738,11 +906,9 @@ func MutateHandler(w http.ResponseWriter, req *http.Request) {
 	additionalNetSelections, addExists := getNetworkSelections(networksAnnotationKey, pod, userDefinedPatch)
 
 	if defExist || addExists {
-		/* map of resources request needed by a pod and a number of them */
-		resourceRequests := make(map[string]int64)
-
-		/* map of node labels on which pod needs to be scheduled*/
-		desiredNsMap := make(map[string]string)
+		/* network selections of the pod, the default network first */
+		var selections []*multus.NetworkSelectionElement
+		resourceCounts := make(map[*multus.NetworkSelectionElement]int64)
 
 		if defaultNetSelection != "" {
 			defNetwork, err := parsePodNetworkSelections(defaultNetSelection, pod.ObjectMeta.Namespace)
@@ -751,17 +917,7 @@ func MutateHandler(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 			if len(defNetwork) == 1 {
-				resourceRequests, desiredNsMap, err = parseNetworkAttachDefinition(defNetwork[0], resourceRequests, desiredNsMap)
-				if err != nil {
-					err = prepareAdmissionReviewResponse(false, err.Error(), ar)
-					if err != nil {
-						glog.Errorf("error preparing AdmissionReview response: %s", err)
-						http.Error(w, err.Error(), http.StatusBadRequest)
-						return
-					}
-					writeResponse(w, ar)
-					return
-				}
+				selections = append(selections, defNetwork[0])
 			}
 		}
 		if additionalNetSelections != "" {
@@ -771,108 +927,115 @@ func MutateHandler(w http.ResponseWriter, req *http.Request) {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			for _, n := range networks {
-				resourceRequests, desiredNsMap, err = parseNetworkAttachDefinition(n, resourceRequests, desiredNsMap)
+			/* invalid overrides are mistakes of the pod, they deny it whatever the failure policy */
+			overrides, err := parseResourceCountOverrides(additionalNetSelections, networks)
+			if err != nil {
+				handleValidationError(w, ar, err)
+				return
+			}
+			for selection, count := range overrides {
+				if count > config.MaxResourceCount {
+					handleValidationError(w, ar, fmt.Errorf("resourceCount %d of network selection '%s/%s' exceeds the maximum of %d",
+						count, selection.Namespace, selection.Name, config.MaxResourceCount))
+					return
+				}
+				resourceCounts[selection] = count
+			}
+			selections = append(selections, networks...)
+		}
+
+		/* resources and node labels needed by each network of the pod */
+		networks, failures := wh.resolveNetworks(ctx, selections, resourceCounts, config)
+		message := "allowed"
+		var warnings []string
+		if len(failures) > 0 {
+			policy := config.FailurePolicyFor(pod.ObjectMeta.Namespace)
+			glog.Infof("failure policy for namespace '%s' is %s", pod.ObjectMeta.Namespace, policy)
+			switch policy {
+			case types.FailurePolicyAllowUnmutated:
+				err = prepareAdmissionReviewResponse(true, "allowed without mutation: "+describeNetworkErrors(failures), ar)
 				if err != nil {
-					err = prepareAdmissionReviewResponse(false, err.Error(), ar)
-					if err != nil {
-						glog.Errorf("error preparing AdmissionReview response: %s", err)
-						http.Error(w, err.Error(), http.StatusBadRequest)
-						return
-					}
-					writeResponse(w, ar)
+					glog.Errorf("error preparing AdmissionReview response: %s", err)
+					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
+				setWarnings(ar, joinNetworkErrors(failures))
+				writeResponse(w, ar)
+				return
+			case types.FailurePolicyAllowPartial:
+				message = "allowed with unresolved networks: " + describeNetworkErrors(failures)
+				warnings = append(warnings, joinNetworkErrors(failures)...)
+			default:
+				handleValidationError(w, ar, errors.New(describeNetworkErrors(failures)))
+				return
 			}
 		}
+		for _, network := range networks {
+			warnings = append(warnings, network.Warnings...)
+		}
+		resourceRequests, desiredNsMap := sumNetworkResources(networks)
 
-		/* patch with custom resources requests and limits */
-		err = prepareAdmissionReviewResponse(true, "allowed", ar)
+		/* mutators replace their part of the previous record, the rest is kept */
+		previousRecord, err := getInjectionRecord(&pod)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		record := &types.InjectionRecord{}
+		if previousRecord != nil {
+			record = previousRecord.DeepCopy()
+		}
+
+		/* run the mutation pipeline on a copy and send the differences as patch */
+		pc := &PodContext{
+			Original:         &pod,
+			Pod:              pod.DeepCopy(),
+			Config:           config,
+			Networks:         networks,
+			ResourceRequests: resourceRequests,
+			NodeSelector:     desiredNsMap,
+			Overhead: sumResourceLists(networks, func(network *NetworkResources) corev1.ResourceList {
+				return network.Overhead
+			}),
+			Hugepages: sumResourceLists(networks, func(network *NetworkResources) corev1.ResourceList {
+				return network.Hugepages
+			}),
+			Tolerations:      mergeTolerations(networks),
+			previousRecord:   previousRecord,
+			record:           record,
+			userDefinedPatch: userDefinedPatch,
+		}
+		mutatorWarnings, err := wh.runMutators(ctx, pc)
+		warnings = append(warnings, mutatorWarnings...)
+		if err == nil {
+			err = setInjectionRecord(pc.Pod, pc.record)
+		}
+		if err != nil {
+			glog.Errorf("%v", err)
+			handleValidationError(w, ar, err)
+			return
+		}
+		patch, err := createPatch(pc.Original, pc.Pod)
+		if err != nil {
+			glog.Errorf("error creating patch: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("patch after all mutations: %s", patch)
+
+		err = prepareAdmissionReviewResponse(true, message, ar)
 		if err != nil {
 			glog.Errorf("error preparing AdmissionReview response: %s", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		var patch []jsonPatchOperation
-		if len(resourceRequests) == 0 {
-			glog.Infof("pod doesn't need any custom network resources")
-		} else {
-			glog.Infof("honor-resources=%v", honorExistingResources)
-			if honorExistingResources {
-				patch = updateResourcePatch(patch, pod.Spec.Containers, resourceRequests)
-			} else {
-				patch = createResourcePatch(patch, pod.Spec.Containers, resourceRequests)
-			}
-
-			// Determine if hugepages are being requested for a given container,
-			// and if so, expose the value to the container via Downward API.
-			var hugepageResourceList []hugepageResourceData
-			glog.Infof("injectHugepageDownApi=%v", injectHugepageDownApi)
-			if injectHugepageDownApi {
-				for containerIndex, container := range pod.Spec.Containers {
-					found := false
-					if len(container.Resources.Requests) != 0 {
-						if quantity, exists := container.Resources.Requests["hugepages-1Gi"]; exists && quantity.IsZero() == false {
-							hugepageResource := hugepageResourceData{
-								ResourceName:  "requests.hugepages-1Gi",
-								ContainerName: container.Name,
-								Path:          types.Hugepages1GRequestPath + "_" + container.Name,
-							}
-							hugepageResourceList = append(hugepageResourceList, hugepageResource)
-							found = true
-						}
-						if quantity, exists := container.Resources.Requests["hugepages-2Mi"]; exists && quantity.IsZero() == false {
-							hugepageResource := hugepageResourceData{
-								ResourceName:  "requests.hugepages-2Mi",
-								ContainerName: container.Name,
-								Path:          types.Hugepages2MRequestPath + "_" + container.Name,
-							}
-							hugepageResourceList = append(hugepageResourceList, hugepageResource)
-							found = true
-						}
-					}
-					if len(container.Resources.Limits) != 0 {
-						if quantity, exists := container.Resources.Limits["hugepages-1Gi"]; exists && quantity.IsZero() == false {
-							hugepageResource := hugepageResourceData{
-								ResourceName:  "limits.hugepages-1Gi",
-								ContainerName: container.Name,
-								Path:          types.Hugepages1GLimitPath + "_" + container.Name,
-							}
-							hugepageResourceList = append(hugepageResourceList, hugepageResource)
-							found = true
-						}
-						if quantity, exists := container.Resources.Limits["hugepages-2Mi"]; exists && quantity.IsZero() == false {
-							hugepageResource := hugepageResourceData{
-								ResourceName:  "limits.hugepages-2Mi",
-								ContainerName: container.Name,
-								Path:          types.Hugepages2MLimitPath + "_" + container.Name,
-							}
-							hugepageResourceList = append(hugepageResourceList, hugepageResource)
-							found = true
-						}
-					}
-
-					// If Hugepages are being added to Downward API, add the
-					// 'container.Name' as an environment variable to the container
-					// so container knows its name and can process hugepages properly.
-					if found {
-						patch = createEnvPatch(patch, &container, containerIndex,
-							types.EnvNameContainerName, container.Name)
-					}
-				}
-			}
-			patch = createVolPatch(patch, hugepageResourceList, &pod)
-			patch = appendCustomizedPatch(patch, pod, userDefinedPatch)
-		}
-		patch = createNodeSelectorPatch(patch, pod.Spec.NodeSelector, desiredNsMap)
-		glog.Infof("patch after all mutations: %v", patch)
-
-		patchBytes, _ := json.Marshal(patch)
-		ar.Response.Patch = patchBytes
-		ar.Response.PatchType = func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}()
+		setWarnings(ar, warnings)
+		if patch != nil {
+			ar.Response.Patch = patch
+			ar.Response.PatchType = func() *v1beta1.PatchType {
+				pt := v1beta1.PatchTypeJSONPatch
+				return &pt
+			}()
+		}
 	} else {
 		/* network annotation not provided or empty */
 		glog.Infof("pod spec doesn't have network annotations. Skipping...")
@@ -889,15 +1052,28 @@ func MutateHandler(w http.ResponseWriter, req *http.Request) {
 
 }
 
-// SetResourceNameKeys extracts resources from a string and add them to resourceNameKeys array
-func SetResourceNameKeys(keys string) error {
+// ParseResourceNameKeys extracts resource name keys from a comma separated string
+func ParseResourceNameKeys(keys string) ([]string, error) {
 	if keys == "" {
-		return errors.New("resoure keys can not be empty")
+		return nil, errors.New("resoure keys can not be empty")
 	}
+	var resourceNameKeys []string
 	for _, resourceNameKey := range strings.Split(keys, ",") {
 		resourceNameKey = strings.TrimSpace(resourceNameKey)
 		resourceNameKeys = append(resourceNameKeys, resourceNameKey)
 	}
+	return resourceNameKeys, nil
+}
+
+// SetResourceNameKeys extracts resources from a string and sets them as the resource name keys
+func SetResourceNameKeys(keys string) error {
+	resourceNameKeys, err := ParseResourceNameKeys(keys)
+	if err != nil {
+		return err
+	}
+	defaultWebhook.updateConfiguration(func(config *types.NRIConfiguration) {
+		config.ResourceNameKeys = resourceNameKeys
+	})
 	return nil
 }
 
@@ -908,32 +1084,43 @@ func SetupInClusterClient() kubernetes.Interface {
 	if err != nil {
 		glog.Fatal(err)
 	}
-	clientset, err = kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		glog.Fatal(err)
 	}
+	defaultWebhook.clientset = clientset
+	defaultWebhook.nadGetter = NewNetworkAttachmentDefinitionGetter(clientset)
 	return clientset
 }
 
 // SetInjectHugepageDownApi sets a flag to indicate whether or not to inject the
 // hugepage request and limit for the Downward API.
 func SetInjectHugepageDownApi(hugepageFlag bool) {
-	injectHugepageDownApi = hugepageFlag
+	defaultWebhook.updateConfiguration(func(config *types.NRIConfiguration) {
+		config.InjectHugepageDownAPI = hugepageFlag
+	})
 }
 
 // SetHonorExistingResources initialize the honorExistingResources flag
 func SetHonorExistingResources(resourcesHonorFlag bool) {
-	honorExistingResources = resourcesHonorFlag
+	defaultWebhook.updateConfiguration(func(config *types.NRIConfiguration) {
+		config.HonorExistingResources = resourcesHonorFlag
+	})
 }
 
 // SetCustomizedInjections sets additional injections to be applied in Pod spec
 func SetCustomizedInjections(injections *corev1.ConfigMap) {
+	defaultWebhook.SetCustomizedInjections(injections)
+}
+
+// SetCustomizedInjections sets additional injections to be applied in Pod spec
+func (wh *Webhook) SetCustomizedInjections(injections *corev1.ConfigMap) {
 	// lock for writing
-	userDefinedInjects.Lock()
-	defer userDefinedInjects.Unlock()
+	wh.userDefinedInjects.Lock()
+	defer wh.userDefinedInjects.Unlock()
 
 	var patch jsonPatchOperation
-	var userDefinedPatchs = userDefinedInjects.Patchs
+	var userDefinedPatchs = wh.userDefinedInjects.Patchs
 
 	for k, v := range injections.Data {
 		existValue, exists := userDefinedPatchs[k]
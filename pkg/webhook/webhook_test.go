@@ -20,12 +20,14 @@ import (
 	. "github.com/onsi/gomega"
 
 	"bytes"
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"gopkg.in/intel/multus-cni.v3/types"
@@ -80,7 +82,7 @@ var _ = Describe("Webhook", func() {
 			It("should return an error", func() {
 				ar := &v1beta1.AdmissionReview{}
 				ar.Request = &v1beta1.AdmissionRequest{}
-				_, err := deserializePod(ar)
+				_, err := defaultWebhook.deserializePod(context.TODO(), ar)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -131,8 +133,8 @@ var _ = Describe("Webhook", func() {
 	DescribeTable("Create user-defined patchs",
 
 		func(pod corev1.Pod, userDefinedInjectPatchs map[string]jsonPatchOperation, out []jsonPatchOperation) {
-			userDefinedInjects.Patchs = userDefinedInjectPatchs
-			appliedPatchs, _ := createCustomizedPatch(pod)
+			defaultWebhook.userDefinedInjects.Patchs = userDefinedInjectPatchs
+			appliedPatchs, _ := defaultWebhook.createCustomizedPatch(pod)
 			Expect(appliedPatchs).Should(Equal(out))
 		},
 		Entry(
@@ -270,7 +272,7 @@ var _ = Describe("Webhook", func() {
 
 		func(in *corev1.ConfigMap, existing map[string]jsonPatchOperation, out map[string]jsonPatchOperation) {
 			SetCustomizedInjections(in)
-			Expect(userDefinedInjects.Patchs).Should(Equal(out))
+			Expect(defaultWebhook.userDefinedInjects.Patchs).Should(Equal(out))
 		},
 		Entry(
 			"patch - empty config map",
@@ -480,4 +482,104 @@ var _ = Describe("Webhook", func() {
 			false,
 		),
 	)
+
+	DescribeTable("Resource count overrides parsing",
+		func(networks string, counts []int64, shouldFail bool) {
+			selections, err := parsePodNetworkSelections(networks, "default")
+			Expect(err).NotTo(HaveOccurred())
+			overrides, err := parseResourceCountOverrides(networks, selections)
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			var actual []int64
+			for _, selection := range selections {
+				actual = append(actual, overrides[selection])
+			}
+			Expect(actual).To(Equal(counts))
+		},
+		Entry("comma separated list", "net-a, net-b", []int64{0, 0}, false),
+		Entry("JSON list", `[{"name": "net-a", "resourceCount": 2}, {"name": "net-b"}]`, []int64{2, 0}, false),
+		Entry("zero count", `[{"name": "net-a", "resourceCount": 0}]`, nil, true),
+		Entry("string count", `[{"name": "net-a", "resourceCount": "2"}]`, nil, true),
+	)
+
+	DescribeTable("Resource list parsing",
+		func(list string, resources []listedResource, shouldFail bool) {
+			actual, err := parseResourceList(list)
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(actual).To(Equal(resources))
+		},
+		Entry("names and counts", "example.com/a, example.com/b=3", []listedResource{
+			{name: "example.com/a", count: 1},
+			{name: "example.com/b", count: 3},
+		}, false),
+		Entry("empty items", "example.com/a,,", []listedResource{{name: "example.com/a", count: 1}}, false),
+		Entry("zero count", "example.com/a=0", nil, true),
+		Entry("missing name", "=2", nil, true),
+		Entry("duplicate resource", "example.com/a, example.com/a=2", nil, true),
+	)
+
+	DescribeTable("Resource overhead parsing",
+		func(value string, shouldFail bool) {
+			_, err := parseResourceOverhead(value)
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		},
+		Entry("cpu, memory and hugepages", "cpu=500m,memory=1Gi,hugepages-2Mi=64Mi", false),
+		Entry("device resource", "example.com/nic-a=1", true),
+		Entry("missing quantity", "cpu", true),
+		Entry("invalid quantity", "cpu=lots", true),
+		Entry("negative quantity", "memory=-1Gi", true),
+		Entry("duplicate resource", "cpu=1,cpu=2", true),
+	)
+
+	DescribeTable("Hugepages parsing",
+		func(value string, hugepages corev1.ResourceList, shouldFail bool) {
+			actual, err := parseHugepages(value)
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(actual).To(Equal(hugepages))
+		},
+		Entry("two sizes", "1Gi=2Gi, 2Mi=512Mi", corev1.ResourceList{
+			"hugepages-1Gi": resource.MustParse("2Gi"),
+			"hugepages-2Mi": resource.MustParse("512Mi"),
+		}, false),
+		Entry("amount not a multiple of the size", "1Gi=1536Mi", nil, true),
+		Entry("missing amount", "2Mi", nil, true),
+		Entry("invalid size", "huge=1Gi", nil, true),
+		Entry("duplicate size", "2Mi=2Mi,2Mi=4Mi", nil, true),
+	)
+
+	DescribeTable("Tolerations parsing",
+		func(value string, length int, shouldFail bool) {
+			tolerations, err := parseTolerations(value)
+			if shouldFail {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tolerations).To(HaveLen(length))
+		},
+		Entry("empty list", `[]`, 0, false),
+		Entry("any taint", `[{"operator": "Exists"}]`, 1, false),
+		Entry("eviction delay", `[{"key": "k", "operator": "Exists", "effect": "NoExecute", "tolerationSeconds": 60}]`, 1, false),
+		Entry("not a list", `{"key": "k"}`, 0, true),
+		Entry("Exists with a value", `[{"key": "k", "operator": "Exists", "value": "v"}]`, 0, true),
+		Entry("Equal without key", `[{"value": "v"}]`, 0, true),
+		Entry("unsupported operator", `[{"key": "k", "operator": "In"}]`, 0, true),
+		Entry("unsupported effect", `[{"key": "k", "effect": "NoRun"}]`, 0, true),
+		Entry("eviction delay without NoExecute", `[{"key": "k", "effect": "NoSchedule", "tolerationSeconds": 60}]`, 0, true),
+	)
 })